@@ -1,27 +1,64 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/caezarr-oss/magina/internal"
 	"github.com/spf13/cobra"
 )
 
 var (
-	version       = "dev"
-	cfgFile       string
-	verboseLevel  int
-	cleanOnError  bool
-	resumeOnError bool
-	rootCmd       *cobra.Command
-	exportCmd     *cobra.Command
-	importCmd     *cobra.Command
-	convertCmd    *cobra.Command
-	transferCmd   *cobra.Command
-	validateCmd   *cobra.Command
-	session       *internal.Session
+	version        = "dev"
+	cfgFile        string
+	verboseLevel   int
+	cleanOnError   bool
+	resume         bool
+	force          bool
+	keepGoing      bool
+	prune          bool
+	storePath      string
+	bundlePath     string
+	staged         bool
+	splitSize      string
+	sinceIndex     string
+	platforms      []string
+	jobs           int
+	maxConns       int
+	retries        int
+	retryBackoff   time.Duration
+	retryMaxWait   time.Duration
+	hostRetries    map[string]int
+	tlsOptions     internal.TLSOptions
+	credentials    credentialFlags
+	srcCredentials credentialFlags
+	dstCredentials credentialFlags
+	nonInteractive bool
+	credStorePath  string
+	keyFile        string
+	providerCmd    string
+	pullSecrets    []string
+	noVerify       bool
+	listLogins     bool
+	testLogins     bool
+	logoutAll      bool
+	loginRole      string
+	credStore      *internal.CredentialStore
+	rootCmd        *cobra.Command
+	exportCmd      *cobra.Command
+	importCmd      *cobra.Command
+	convertCmd     *cobra.Command
+	transferCmd    *cobra.Command
+	syncCmd        *cobra.Command
+	validateCmd    *cobra.Command
+	loginCmd       *cobra.Command
+	logoutCmd      *cobra.Command
+	session        *internal.Session
 )
 
 func init() {
@@ -33,14 +70,27 @@ func init() {
 		Short:   "Gérer les images OCI entre les registres",
 		Long:    `Magina est un outil pour gérer les images OCI entre les registres en utilisant la configuration BRMS.`,
 		Version: version,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := openCredentialStore(); err != nil {
+				return err
+			}
+			if err := setCredentialProvider(); err != nil {
+				return err
+			}
+			if err := setPullSecrets(); err != nil {
+				return err
+			}
+			return setExplicitCredentials()
+		},
 	}
 
 	// Commande d'exportation
 	exportCmd = &cobra.Command{
 		Use:   "export",
-		Short: "Exporter les images du registre source vers l'hôte local",
-		Long: `Exporter les images du registre source spécifié dans la configuration BRMS vers l'hôte local.
-La configuration doit contenir exactement un bloc avec les informations du registre source.
+		Short: "Exporter les images du registre source vers le stockage local",
+		Long: `Exporter les images du registre source spécifié dans la configuration BRMS vers le stockage local.
+Les images sont écrites dans un répertoire au format OCI image layout (voir --store).
+Chaque bloc de la configuration est traité dans l'ordre du fichier.
 Format : [protocole://export-host|]
 Exemple : magina export -c config.brms`,
 		RunE: handleExport,
@@ -61,9 +111,10 @@ Exemple : magina convert -c config.brms`,
 	importCmd = &cobra.Command{
 		Use:   "import",
 		Short: "Importer les images locales vers le registre de destination",
-		Long: `Importer les images locales vers le registre de destination spécifié dans la configuration BRMS.
-La configuration doit contenir exactement un bloc avec les informations du registre de destination.
+		Long: `Importer les images du stockage local vers le registre de destination spécifié dans la configuration BRMS.
+Chaque bloc de la configuration est traité dans l'ordre du fichier.
 Nécessite la présence des images locales avec les tags corrects à partir d'une opération de conversion précédente.
+Avec --bundle et sans -c, les images sont poussées d'après la configuration et l'index du bundle.
 Format : [|protocole://import-host]
 Exemple : magina import -c config.brms`,
 		RunE: handleImport,
@@ -72,9 +123,13 @@ Exemple : magina import -c config.brms`,
 	// Commande de transfert
 	transferCmd = &cobra.Command{
 		Use:   "transfer",
-		Short: "Effectuer le workflow de transfert complet (export + conversion + importation)",
-		Long: `Exécuter le workflow de transfert complet :
-1. Exporter les images du registre source vers l'hôte local
+		Short: "Copier les images du registre source vers le registre de destination",
+		Long: `Copier chaque image directement du registre source vers le registre de destination :
+les blobs transitent en flux sans passer par le disque, et sont montés d'un dépôt à
+l'autre lorsque les deux sont sur le même registre.
+
+Avec --staged, exécuter plutôt le workflow en trois phases via le stockage local :
+1. Exporter les images du registre source vers le stockage local
 2. Convertir (retaguer) les images locales
 3. Importer les images vers le registre de destination
 Format : [protocole://source-host|protocole://dest-host]
@@ -82,6 +137,20 @@ Exemple : magina transfer -c config.brms`,
 		RunE: handleTransfer,
 	}
 
+	// Commande de synchronisation
+	syncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Synchroniser des dépôts entiers du registre source vers le registre de destination",
+		Long: `Synchroniser des dépôts entiers : chaque ligne de la configuration BRMS nomme un dépôt,
+sans tag ni digest, dont tous les tags sont copiés directement vers le registre de destination.
+Les tags déjà à jour sont ignorés ; les tags de destination absents de la source sont listés,
+puis supprimés avec --prune, sauf s'ils sont exclus.
+Format : [protocole://source-host|protocole://dest-host]
+         library/nginx|mirror/nginx
+Exemple : magina sync -c mirror.brms --prune`,
+		RunE: handleSync,
+	}
+
 	// Commande de validation
 	validateCmd = &cobra.Command{
 		Use:   "validate",
@@ -90,21 +159,122 @@ Exemple : magina transfer -c config.brms`,
 Vérifications :
 - Validation de la syntaxe
 - Spécification du protocole
-- Exigence d'un seul bloc
+- Présence d'au moins un bloc
 - Accessibilité du registre
 Exemple : magina validate -c config.brms`,
 		RunE: handleValidate,
 	}
 
+	// Commande de connexion
+	loginCmd = &cobra.Command{
+		Use:   "login [registre]",
+		Short: "Enregistrer les identifiants d'un registre dans le magasin chiffré",
+		Long: `Enregistrer les identifiants d'un registre dans le magasin d'identifiants chiffré.
+Les identifiants sont vérifiés auprès du registre avant d'être enregistrés (voir --no-verify).
+Le magasin est chiffré avec une phrase secrète ($MAGINA_PASSPHRASE ou saisie) ou un fichier de clé (--key-file).
+Le registre peut être suivi d'un préfixe de dépôt, et l'entrée réservée à un rôle avec --role.
+Exemples :
+  magina login https://registry.example.com
+  magina login https://harbor.example.com/project-a --role destination
+  magina login --list
+  magina login --test [registre...]`,
+		// Les identifiants sont lus par la commande elle-même
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return openCredentialStore()
+		},
+		RunE: handleLogin,
+	}
+
+	// Commande de déconnexion
+	logoutCmd = &cobra.Command{
+		Use:   "logout [registre]",
+		Short: "Supprimer les identifiants d'un registre du magasin chiffré",
+		Long: `Supprimer les identifiants enregistrés pour un registre.
+Avec --all, le magasin est supprimé entièrement, sans demander la phrase secrète.
+Exemple : magina logout https://registry.example.com`,
+		RunE: handleLogout,
+	}
+
 	// Flags globaux
-	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "Fichier de configuration BRMS (obligatoire)")
-	rootCmd.MarkPersistentFlagRequired("config")
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "Fichier de configuration BRMS (obligatoire sauf pour login, logout et import --bundle)")
 	rootCmd.PersistentFlags().IntVarP(&verboseLevel, "verbose", "v", 0, "Niveau de verbosité (0-3)")
+	rootCmd.PersistentFlags().StringVar(&credStorePath, "credential-store", "", "Magasin d'identifiants chiffré (par défaut : <config utilisateur>/magina/credentials.enc)")
+	rootCmd.PersistentFlags().StringVar(&providerCmd, "credential-provider", "", "Exécutable fournissant les identifiants de chaque registre (par défaut : $MAGINA_CREDENTIAL_PROVIDER)")
+	rootCmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "Fichier de clé (32 octets ou plus) chiffrant le magasin d'identifiants, à la place de la phrase secrète")
 
 	// Flags pour les commandes de transfert
 	for _, cmd := range []*cobra.Command{exportCmd, importCmd, convertCmd, transferCmd} {
-		cmd.Flags().BoolVar(&cleanOnError, "clean-on-error", false, "Nettoyer les images téléchargées/converties en cas d'erreur")
-		cmd.Flags().BoolVar(&resumeOnError, "resume", false, "Essayer de reprendre à partir de la dernière opération réussie")
+		cmd.Flags().BoolVar(&cleanOnError, "clean-on-error", false, "En cas d'échec, annuler ce que l'exécution a écrit : entrées du stockage local, tags et manifestes poussés")
+		cmd.Flags().StringVar(&storePath, "store", "", "Répertoire du stockage OCI local (par défaut : <cache utilisateur>/magina/store)")
+		cmd.Flags().StringSliceVar(&platforms, "platform", nil, "Ne conserver que ces plateformes des index multi-plateformes (ex. linux/amd64,linux/arm64)")
+		cmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "Nombre d'images traitées en parallèle")
+	}
+
+	// Flags TLS pour les commandes qui contactent les registres
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd, transferCmd, syncCmd, loginCmd} {
+		cmd.Flags().StringVar(&tlsOptions.CertsDir, "certs-dir", "", "Répertoire des certificats par registre <dir>/<hôte>/{ca.crt,client.cert,client.key} (par défaut : <config utilisateur>/magina/certs.d)")
+		cmd.Flags().StringVar(&tlsOptions.CACert, "ca-cert", "", "Certificat d'autorité supplémentaire pour tous les registres")
+		cmd.Flags().StringVar(&tlsOptions.ClientCert, "client-cert", "", "Certificat client (mTLS) pour tous les registres")
+		cmd.Flags().StringVar(&tlsOptions.ClientKey, "client-key", "", "Clé du certificat client")
+	}
+
+	// Limite de connexions pour les commandes qui contactent les registres
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd, transferCmd, syncCmd} {
+		cmd.Flags().IntVar(&maxConns, "max-conns-per-host", internal.DefaultMaxConnsPerHost, "Nombre maximal de connexions simultanées par registre (0 : illimité)")
+	}
+
+	// Reprise d'une exécution interrompue
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd, transferCmd} {
+		cmd.Flags().BoolVar(&resume, "resume", false, "Reprendre une exécution interrompue : ignorer les images déjà traitées d'après le journal")
+	}
+	for _, cmd := range []*cobra.Command{transferCmd, syncCmd} {
+		cmd.Flags().BoolVar(&keepGoing, "keep-going", false, "Continuer avec les images suivantes après un échec")
+	}
+
+	// Images déjà à jour dans le registre de destination
+	for _, cmd := range []*cobra.Command{importCmd, transferCmd, syncCmd} {
+		cmd.Flags().BoolVar(&force, "force", false, "Pousser les images même lorsque le tag de destination pointe déjà sur le même manifeste")
+	}
+
+	// Nouvelles tentatives sur les erreurs transitoires des registres
+	defaultRetry := internal.DefaultRetryPolicy()
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd, transferCmd, syncCmd} {
+		cmd.Flags().IntVar(&retries, "retries", defaultRetry.MaxAttempts, "Nombre de tentatives par image sur une erreur transitoire (1 : aucune nouvelle tentative)")
+		cmd.Flags().DurationVar(&retryBackoff, "retry-backoff", defaultRetry.Backoff, "Délai avant la première nouvelle tentative, doublé à chaque tentative")
+		cmd.Flags().DurationVar(&retryMaxWait, "retry-max-backoff", defaultRetry.MaxBackoff, "Délai maximal entre deux tentatives, hors Retry-After du registre")
+		cmd.Flags().StringToIntVar(&hostRetries, "registry-retries", nil, "Nombre de tentatives propre à un registre (ex. registry.example.com=5)")
+	}
+
+	// Flags d'authentification, prioritaires sur l'environnement et la configuration Docker
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd, transferCmd, syncCmd} {
+		credentials.register(cmd, "", "tous les registres")
+		srcCredentials.register(cmd, "src-", "le registre source")
+		dstCredentials.register(cmd, "dst-", "le registre de destination")
+		cmd.Flags().BoolVar(&nonInteractive, "non-interactive", false, "Ne jamais demander d'identifiants : échouer avec le code 4 s'ils sont introuvables")
+		cmd.Flags().StringSliceVar(&pullSecrets, "pull-secret", nil, "Secret Kubernetes kubernetes.io/dockerconfigjson (YAML ou JSON) ou fichier .dockerconfigjson fournissant les identifiants par registre")
+	}
+
+	// Flags pour les bundles hors ligne
+	exportCmd.Flags().StringVar(&bundlePath, "bundle", "", "Écrire les images exportées dans une archive autonome (tar)")
+	exportCmd.Flags().StringVar(&splitSize, "split-size", "", "Découper le bundle en volumes de taille maximale (ex. 4GiB, 700MB)")
+	exportCmd.Flags().StringVar(&sinceIndex, "since", "", "Index d'un bundle précédent : n'inclure que les blobs absents de celui-ci")
+	importCmd.Flags().StringVar(&bundlePath, "bundle", "", "Importer les images depuis une archive produite par export --bundle (sans -c : d'après la configuration du bundle)")
+	transferCmd.Flags().BoolVar(&staged, "staged", false, "Passer par le stockage local (export, conversion, importation) au lieu de copier directement")
+
+	// Flags de synchronisation
+	syncCmd.Flags().StringSliceVar(&platforms, "platform", nil, "Ne conserver que ces plateformes des index multi-plateformes (ex. linux/amd64,linux/arm64)")
+	syncCmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "Nombre de tags copiés en parallèle")
+	syncCmd.Flags().BoolVar(&prune, "prune", false, "Supprimer les tags de destination absents de la source, hors exclusions")
+
+	// Flags de gestion du magasin d'identifiants
+	credentials.register(loginCmd, "", "le registre")
+	loginCmd.Flags().BoolVar(&nonInteractive, "non-interactive", false, "Ne jamais demander d'identifiants")
+	loginCmd.Flags().BoolVar(&noVerify, "no-verify", false, "Enregistrer les identifiants sans les vérifier auprès du registre")
+	loginCmd.Flags().BoolVar(&listLogins, "list", false, "Lister les registres enregistrés")
+	loginCmd.Flags().BoolVar(&testLogins, "test", false, "Vérifier les identifiants enregistrés (tous si aucun registre n'est donné)")
+	logoutCmd.Flags().BoolVar(&logoutAll, "all", false, "Supprimer tous les identifiants enregistrés")
+	for _, cmd := range []*cobra.Command{loginCmd, logoutCmd} {
+		cmd.Flags().StringVar(&loginRole, "role", "", "Réserver l'entrée à un rôle : source (lecture) ou destination (écriture) ; par défaut, les deux")
 	}
 
 	// Ajouter les sous-commandes
@@ -112,325 +282,1272 @@ Exemple : magina validate -c config.brms`,
 	rootCmd.AddCommand(convertCmd)
 	rootCmd.AddCommand(importCmd)
 	rootCmd.AddCommand(transferCmd)
+	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(logoutCmd)
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	// Interrompre proprement les transferts en cours sur Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Println(err)
+
+		// Code de retour documenté pour les erreurs d'authentification
+		var authErr *internal.AuthError
+		if errors.As(err, &authErr) {
+			os.Exit(4)
+		}
 		os.Exit(1)
 	}
 }
 
 // Les gestionnaires seront implémentés dans des fichiers séparés
-func handleExport(cmd *cobra.Command, args []string) error {
-	config, err := internal.ParseConfig(cfgFile)
+func handleExport(cmd *cobra.Command, args []string) (err error) {
+	config, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("échec de l'analyse de la configuration : %w", err)
+		return err
 	}
 
-	if len(config.Blocks) != 1 {
-		return fmt.Errorf("l'export nécessite exactement un bloc dans la configuration, trouvé %d", len(config.Blocks))
+	// Plateformes conservées des index multi-plateformes
+	platformFilter, err := internal.ParsePlatforms(platforms)
+	if err != nil {
+		return err
 	}
 
-	block := config.Blocks[0]
+	// Artefacts écrits, annulés si l'exécution échoue
+	rollback := newRollback()
+	defer func() {
+		if err != nil {
+			cleanUp(cmd.Context(), rollback)
+		}
+	}()
 
-	// Obtenir les informations d'identification pour le registre source
-	creds, err := session.GetCredentials(block.SourceRegistry.Host)
+	// Politique de nouvelles tentatives
+	retry, err := retryPolicy()
 	if err != nil {
-		return fmt.Errorf("échec de l'obtention des informations d'identification : %w", err)
+		return err
 	}
 
-	// Créer les options d'exportation
-	options := internal.ExportOptions{
-		CleanOnError: cleanOnError,
-		VerboseLevel: verboseLevel,
-		Credentials:  creds,
+	// Taille maximale des volumes du bundle
+	var volumeSize int64
+	if splitSize != "" {
+		if bundlePath == "" {
+			return fmt.Errorf("--split-size nécessite --bundle")
+		}
+		if volumeSize, err = internal.ParseSize(splitSize); err != nil {
+			return fmt.Errorf("taille de volume invalide : %w", err)
+		}
 	}
 
-	// Créer le gestionnaire d'exportation
-	handler := internal.NewExportHandler(cmd.Context(), options)
+	// Bundle précédent pour un export incrémental
+	var baseBundle *internal.BundleIndex
+	if sinceIndex != "" {
+		if bundlePath == "" {
+			return fmt.Errorf("--since nécessite --bundle")
+		}
+		if baseBundle, err = internal.ReadBundleIndex(sinceIndex); err != nil {
+			return fmt.Errorf("échec de la lecture du bundle précédent : %w", err)
+		}
+	}
 
-	// Démarrer l'exportation
-	results := handler.ExportImages(block)
+	// Exporter dans un stockage temporaire lorsqu'un bundle est demandé
+	exportStore := storePath
+	if bundlePath != "" {
+		stageDir, err := os.MkdirTemp("", "magina-bundle-")
+		if err != nil {
+			return fmt.Errorf("échec de la création du répertoire temporaire : %w", err)
+		}
+		defer os.RemoveAll(stageDir)
+		exportStore = stageDir
+	}
 
-	// Compteurs pour le suivi
-	var totalImages, successCount, failureCount int
+	// Journal de reprise, sans objet pour un bundle exporté dans un stockage temporaire
+	var journal *internal.Journal
+	if bundlePath == "" {
+		if journal, err = openJournal(internal.PhaseExport); err != nil {
+			return err
+		}
+	} else if resume {
+		return fmt.Errorf("--resume est incompatible avec --bundle")
+	}
 
-	// Traiter les résultats
-	for result := range results {
-		totalImages++
-		if result.Error != nil {
-			failureCount++
-			fmt.Printf("❌ ÉCHEC  %s\n", result.SourceImage)
-			if verboseLevel > 0 {
-				fmt.Printf("   Erreur : %v\n", result.Error)
-			}
-		} else {
-			successCount++
-			if verboseLevel > 0 {
-				fmt.Printf("✅ SUCCÈS %s -> %s\n", result.SourceImage, result.LocalImage)
+	bundle := internal.NewBundleIndex()
+	var totalFailures int
+
+	for i, block := range config.Blocks {
+		printBlockHeader(i, len(config.Blocks), block)
+
+		// Obtenir les informations d'identification pour le registre source dès le
+		// début du bloc ; les identifiants qui expirent sont renouvelés en cours de route
+		if _, err := session.GetCredentials(cmd.Context(), internal.RoleSource, block.SourceRegistry.Host); err != nil {
+			return fmt.Errorf("échec de l'obtention des informations d'identification : %w", err)
+		}
+
+		// Créer les options d'exportation
+		options := internal.ExportOptions{
+			Rollback:     rollback,
+			VerboseLevel: verboseLevel,
+			Auth:         session.Authenticator(cmd.Context(), internal.RoleSource, block.SourceRegistry.Host),
+			StorePath:    exportStore,
+			Platforms:    platformFilter,
+			TLS:          tlsOptions,
+			Jobs:         jobs,
+			MaxConns:     maxConns,
+			Retry:        retry,
+			Journal:      journal,
+		}
+
+		// Créer le gestionnaire d'exportation
+		handler := internal.NewExportHandler(cmd.Context(), options)
+
+		// Démarrer l'exportation
+		results := handler.ExportImages(block)
+
+		// Compteurs pour le suivi
+		var totalImages, successCount, failureCount int
+
+		// Traiter les résultats
+		for result := range results {
+			totalImages++
+			if result.Error != nil {
+				failureCount++
+				fmt.Printf("❌ ÉCHEC  %s%s\n", result.SourceImage, retriesLabel(result.Retries))
+				if verboseLevel > 0 {
+					fmt.Printf("   Erreur : %v\n", result.Error)
+				}
+			} else {
+				successCount++
+				bundle.AddImage(result.SourceImage, result.LocalImage, result.Digest)
+				if result.Resumed {
+					printResumed(result.SourceImage)
+				} else if verboseLevel > 0 {
+					fmt.Printf("✅ SUCCÈS %s -> %s", result.SourceImage, result.LocalImage)
+					if result.Referrers > 0 {
+						fmt.Printf(" (+%d artefacts attachés)", result.Referrers)
+					}
+					fmt.Println(retriesLabel(result.Retries))
+				}
 			}
 		}
+
+		// Afficher le résumé du bloc
+		printSummary("de l'exportation", i, len(config.Blocks), totalImages, successCount, 0, failureCount)
+		totalFailures += failureCount
 	}
 
-	// Afficher le résumé
-	fmt.Printf("\nRésumé de l'exportation :\n")
-	fmt.Printf("Total des images :  %d\n", totalImages)
-	fmt.Printf("Réussites :    %d\n", successCount)
-	fmt.Printf("Échecs :        %d\n", failureCount)
+	if totalFailures > 0 {
+		return fmt.Errorf("%d images n'ont pas pu être exportées", totalFailures)
+	}
+	removeJournal(journal)
+
+	// Écrire le bundle à partir du stockage temporaire
+	if bundlePath != "" {
+		store, err := internal.OpenStore(exportStore)
+		if err != nil {
+			return fmt.Errorf("échec de l'ouverture du stockage local : %w", err)
+		}
+
+		bundleOptions := internal.BundleOptions{
+			SplitSize: volumeSize,
+			Base:      baseBundle,
+		}
+		if err := internal.WriteBundle(bundlePath, store, cfgFile, bundle, bundleOptions); err != nil {
+			return fmt.Errorf("échec de l'écriture du bundle : %w", err)
+		}
 
-	if failureCount > 0 {
-		return fmt.Errorf("%d images n'ont pas pu être exportées", failureCount)
+		fmt.Printf("\nBundle écrit : %s (%d images)\n", bundlePath, len(bundle.Images))
+		if bundle.Base != nil {
+			fmt.Printf("  Incrémental depuis %s : %d blobs déjà livrés omis\n", bundle.Base.ID, bundle.Base.SkippedBlobs)
+		}
+		for i, volume := range bundle.Volumes {
+			fmt.Printf("  Volume %d : %s (%d octets)\n", i+1, volume.Name, volume.Size)
+		}
 	}
 
 	return nil
 }
 
-func handleConvert(cmd *cobra.Command, args []string) error {
-	config, err := internal.ParseConfig(cfgFile)
+func handleConvert(cmd *cobra.Command, args []string) (err error) {
+	config, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("échec de l'analyse de la configuration : %w", err)
+		return err
 	}
 
-	if len(config.Blocks) != 1 {
-		return fmt.Errorf("la conversion nécessite exactement un bloc dans la configuration, trouvé %d", len(config.Blocks))
+	// Plateformes conservées des index multi-plateformes
+	platformFilter, err := internal.ParsePlatforms(platforms)
+	if err != nil {
+		return err
 	}
 
-	block := config.Blocks[0]
+	// Artefacts écrits, annulés si l'exécution échoue
+	rollback := newRollback()
+	defer func() {
+		if err != nil {
+			cleanUp(cmd.Context(), rollback)
+		}
+	}()
 
-	// Créer les options de conversion
-	options := internal.ConvertOptions{
-		CleanOnError: cleanOnError,
-		VerboseLevel: verboseLevel,
-	}
+	var convertErr error
 
-	// Créer le gestionnaire de conversion
-	handler := internal.NewConvertHandler(cmd.Context(), options)
+	for i, block := range config.Blocks {
+		printBlockHeader(i, len(config.Blocks), block)
 
-	// Démarrer la conversion
-	results := handler.ConvertImages(block)
+		// Créer les options de conversion
+		options := internal.ConvertOptions{
+			Rollback:     rollback,
+			VerboseLevel: verboseLevel,
+			StorePath:    storePath,
+			Platforms:    platformFilter,
+			Jobs:         jobs,
+		}
 
-	// Compteurs pour le suivi
-	var totalImages, successCount, failureCount int
+		// Créer le gestionnaire de conversion
+		handler := internal.NewConvertHandler(cmd.Context(), options)
 
-	// Traiter les résultats
-	for result := range results {
-		totalImages++
-		if result.Error != nil {
-			failureCount++
-			fmt.Printf("❌ ÉCHEC  %s -> %s : %v\n", result.SourceImage, result.DestinationImage, result.Error)
-			return fmt.Errorf("échec de la conversion de l'image : %w", result.Error)
-		}
+		// Démarrer la conversion
+		results := handler.ConvertImages(block)
 
-		successCount++
-		fmt.Printf("✅ SUCCÈS %s -> %s\n", result.SourceImage, result.DestinationImage)
-	}
+		// Compteurs pour le suivi
+		var totalImages, successCount, failureCount int
 
-	// Afficher le résumé
-	fmt.Printf("\nRésumé de la conversion :\n")
-	fmt.Printf("Total des images :  %d\n", totalImages)
-	fmt.Printf("Réussites :    %d\n", successCount)
-	fmt.Printf("Échecs :        %d\n", failureCount)
+		// Traiter les résultats
+		for result := range results {
+			totalImages++
+			if result.Error != nil {
+				failureCount++
+				fmt.Printf("❌ ÉCHEC  %s -> %s : %v\n", result.SourceImage, result.DestinationImage, result.Error)
+				// Laisser finir les conversions en cours avant de s'arrêter
+				if convertErr == nil {
+					convertErr = fmt.Errorf("échec de la conversion de l'image : %w", result.Error)
+				}
+				continue
+			}
 
-	if failureCount > 0 {
-		return fmt.Errorf("%d images n'ont pas pu être converties", failureCount)
+			successCount++
+			fmt.Printf("✅ SUCCÈS %s -> %s\n", result.SourceImage, result.DestinationImage)
+		}
+
+		// Afficher le résumé du bloc
+		printSummary("de la conversion", i, len(config.Blocks), totalImages, successCount, 0, failureCount)
+
+		if convertErr != nil {
+			return convertErr
+		}
 	}
 
 	return nil
 }
 
-func handleImport(cmd *cobra.Command, args []string) error {
-	config, err := internal.ParseConfig(cfgFile)
-	if err != nil {
-		return fmt.Errorf("échec de l'analyse de la configuration : %w", err)
+func handleImport(cmd *cobra.Command, args []string) (err error) {
+	// Sans -c, un bundle fournit lui-même sa configuration
+	var config *internal.Config
+	if bundlePath == "" || cfgFile != "" {
+		if config, err = loadConfig(); err != nil {
+			return err
+		}
 	}
 
-	if len(config.Blocks) != 1 {
-		return fmt.Errorf("l'importation nécessite exactement un bloc dans la configuration, trouvé %d", len(config.Blocks))
+	// Plateformes conservées des index multi-plateformes
+	platformFilter, err := internal.ParsePlatforms(platforms)
+	if err != nil {
+		return err
 	}
 
-	block := config.Blocks[0]
+	// Artefacts écrits, annulés si l'exécution échoue
+	rollback := newRollback()
+	defer func() {
+		if err != nil {
+			cleanUp(cmd.Context(), rollback)
+		}
+	}()
 
-	// Obtenir les informations d'identification pour le registre de destination
-	creds, err := session.GetCredentials(block.DestinationRegistry.Host)
+	// Politique de nouvelles tentatives
+	retry, err := retryPolicy()
 	if err != nil {
-		return fmt.Errorf("échec de l'obtention des informations d'identification : %w", err)
+		return err
 	}
 
-	// Créer les options d'importation
-	options := internal.ImportOptions{
-		CleanOnError: cleanOnError,
-		VerboseLevel: verboseLevel,
-		Credentials:  creds,
+	// Charger le bundle dans le stockage local
+	var bundle *internal.BundleIndex
+	if bundlePath != "" {
+		store, err := internal.OpenStore(storePath)
+		if err != nil {
+			return fmt.Errorf("échec de l'ouverture du stockage local : %w", err)
+		}
+
+		if bundle, err = internal.ExtractBundle(bundlePath, store); err != nil {
+			return fmt.Errorf("échec du chargement du bundle : %w", err)
+		}
+
+		fmt.Printf("Bundle chargé : %s (%d images vérifiées)\n", bundlePath, len(bundle.Images))
 	}
 
-	// Créer le gestionnaire d'importation
-	handler := internal.NewImportHandler(cmd.Context(), options)
+	// Pousser les images du bundle d'après la configuration et l'index qu'il contient
+	if config == nil {
+		if config, err = bundle.ImportConfig(); err != nil {
+			return fmt.Errorf("échec de la lecture de la configuration du bundle : %w", err)
+		}
+	}
 
-	// Démarrer l'importation
-	results := handler.ImportImages(block)
+	// Journal de reprise, propre au bundle lorsqu'il fournit la configuration
+	var journal *internal.Journal
+	if cfgFile != "" {
+		journal, err = openJournal(internal.PhaseImport)
+	} else {
+		journal, err = openBundleJournal(bundle, internal.PhaseImport)
+	}
+	if err != nil {
+		return err
+	}
 
-	// Compteurs pour le suivi
-	var totalImages, successCount, failureCount int
+	var totalFailures int
 
-	// Traiter les résultats
-	for result := range results {
-		totalImages++
-		if result.Error != nil {
-			failureCount++
-			fmt.Printf("❌ ÉCHEC  %s\n", result.DestinationImage)
-			if verboseLevel > 0 {
-				fmt.Printf("   Erreur : %v\n", result.Error)
-			}
-		} else {
-			successCount++
-			if verboseLevel > 0 {
-				fmt.Printf("✅ SUCCÈS %s\n", result.DestinationImage)
+	for i, block := range config.Blocks {
+		printBlockHeader(i, len(config.Blocks), block)
+
+		// Obtenir les informations d'identification pour le registre de destination dès le
+		// début du bloc ; les identifiants qui expirent sont renouvelés en cours de route
+		if _, err := session.GetCredentials(cmd.Context(), internal.RoleDestination, block.DestinationRegistry.Host); err != nil {
+			return fmt.Errorf("échec de l'obtention des informations d'identification : %w", err)
+		}
+
+		// Créer les options d'importation
+		options := internal.ImportOptions{
+			Rollback:     rollback,
+			VerboseLevel: verboseLevel,
+			Auth:         session.Authenticator(cmd.Context(), internal.RoleDestination, block.DestinationRegistry.Host),
+			StorePath:    storePath,
+			Platforms:    platformFilter,
+			TLS:          tlsOptions,
+			Jobs:         jobs,
+			MaxConns:     maxConns,
+			Retry:        retry,
+			Journal:      journal,
+			Force:        force,
+		}
+
+		// Créer le gestionnaire d'importation
+		handler := internal.NewImportHandler(cmd.Context(), options)
+
+		// Démarrer l'importation
+		results := handler.ImportImages(block)
+
+		// Compteurs pour le suivi
+		var totalImages, successCount, skippedCount, failureCount int
+
+		// Traiter les résultats
+		for result := range results {
+			totalImages++
+			if result.Error != nil {
+				failureCount++
+				fmt.Printf("❌ ÉCHEC  %s%s\n", result.DestinationImage, retriesLabel(result.Retries))
+				if verboseLevel > 0 {
+					fmt.Printf("   Erreur : %v\n", result.Error)
+				}
+			} else if result.Skipped {
+				skippedCount++
+				printSkipped(result.DestinationImage)
+			} else {
+				successCount++
+				if result.Resumed {
+					printResumed(result.DestinationImage)
+				} else if verboseLevel > 0 {
+					fmt.Printf("✅ SUCCÈS %s", result.DestinationImage)
+					if result.Referrers > 0 {
+						fmt.Printf(" (+%d artefacts attachés)", result.Referrers)
+					}
+					fmt.Println(retriesLabel(result.Retries))
+				}
 			}
 		}
-	}
 
-	// Afficher le résumé
-	fmt.Printf("\nRésumé de l'importation :\n")
-	fmt.Printf("Total des images :  %d\n", totalImages)
-	fmt.Printf("Réussites :    %d\n", successCount)
-	fmt.Printf("Échecs :        %d\n", failureCount)
+		// Afficher le résumé du bloc
+		printSummary("de l'importation", i, len(config.Blocks), totalImages, successCount, skippedCount, failureCount)
+		totalFailures += failureCount
+	}
 
-	if failureCount > 0 {
-		return fmt.Errorf("%d images n'ont pas pu être importées", failureCount)
+	if totalFailures > 0 {
+		return fmt.Errorf("%d images n'ont pas pu être importées", totalFailures)
 	}
+	removeJournal(journal)
 
 	return nil
 }
 
-func handleTransfer(cmd *cobra.Command, args []string) error {
-	config, err := internal.ParseConfig(cfgFile)
+func handleTransfer(cmd *cobra.Command, args []string) (err error) {
+	config, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("échec de l'analyse de la configuration : %w", err)
+		return err
 	}
 
-	if len(config.Blocks) != 1 {
-		return fmt.Errorf("le transfert nécessite exactement un bloc dans la configuration, trouvé %d", len(config.Blocks))
+	// Plateformes conservées des index multi-plateformes
+	platformFilter, err := internal.ParsePlatforms(platforms)
+	if err != nil {
+		return err
 	}
 
-	block := config.Blocks[0]
+	// Artefacts écrits, annulés si l'exécution échoue
+	rollback := newRollback()
+	defer func() {
+		if err != nil {
+			cleanUp(cmd.Context(), rollback)
+		}
+	}()
 
-	// Créer les options de transfert
-	options := internal.TransferOptions{
-		CleanOnError:  cleanOnError,
-		VerboseLevel:  verboseLevel,
-		ResumeOnError: resumeOnError,
+	// Politique de nouvelles tentatives
+	retry, err := retryPolicy()
+	if err != nil {
+		return err
 	}
 
-	// Créer le gestionnaire de transfert
-	handler := internal.NewTransferHandler(cmd.Context(), options, session)
-
-	// Démarrer le transfert
-	results := handler.TransferImages(block)
-
-	// Compteurs pour le suivi
-	counters := make(map[internal.TransferPhase]struct {
-		total    int
-		success  int
-		failures int
-	})
+	// Journal de reprise, des phases du workflow choisi
+	phases := []internal.TransferPhase{internal.PhaseCopy}
+	if staged {
+		phases = []internal.TransferPhase{internal.PhaseExport, internal.PhaseImport}
+	}
+	journal, err := openJournal(phases...)
+	if err != nil {
+		return err
+	}
 
-	// Traiter les résultats
-	for result := range results {
-		phase := result.Phase
-		stats := counters[phase]
-		stats.total++
+	var totalFailures int
+	var authErr *internal.AuthError
+
+	for i, block := range config.Blocks {
+		printBlockHeader(i, len(config.Blocks), block)
+
+		// Créer les options de transfert
+		options := internal.TransferOptions{
+			Rollback:     rollback,
+			VerboseLevel: verboseLevel,
+			KeepGoing:    keepGoing,
+			Staged:       staged,
+			StorePath:    storePath,
+			Platforms:    platformFilter,
+			TLS:          tlsOptions,
+			Jobs:         jobs,
+			MaxConns:     maxConns,
+			Retry:        retry,
+			Journal:      journal,
+			Force:        force,
+		}
 
-		if result.Error != nil {
-			stats.failures++
-			fmt.Printf("❌ %s ÉCHEC  ", phase)
-			if result.SourceImage != "" {
-				fmt.Printf("%s", result.SourceImage)
-			}
-			if result.DestinationImage != "" {
-				fmt.Printf(" -> %s", result.DestinationImage)
-			}
-			fmt.Println()
-			if verboseLevel > 0 {
-				fmt.Printf("   Erreur : %v\n", result.Error)
-			}
-		} else {
-			stats.success++
-			if verboseLevel > 0 {
-				fmt.Printf("✅ %s SUCCÈS  ", phase)
+		// Créer le gestionnaire de transfert
+		handler := internal.NewTransferHandler(cmd.Context(), options, session)
+
+		// Démarrer le transfert
+		results := handler.TransferImages(block)
+
+		// Compteurs pour le suivi
+		counters := make(map[internal.TransferPhase]struct {
+			total    int
+			success  int
+			skipped  int
+			failures int
+		})
+
+		// Traiter les résultats
+		for result := range results {
+			phase := result.Phase
+			stats := counters[phase]
+			stats.total++
+
+			if result.Error != nil {
+				stats.failures++
+				errors.As(result.Error, &authErr)
+				fmt.Printf("❌ %s ÉCHEC  ", phase)
 				if result.SourceImage != "" {
 					fmt.Printf("%s", result.SourceImage)
 				}
 				if result.DestinationImage != "" {
 					fmt.Printf(" -> %s", result.DestinationImage)
 				}
-				fmt.Println()
+				fmt.Println(retriesLabel(result.Retries))
+				if verboseLevel > 0 {
+					fmt.Printf("   Erreur : %v\n", result.Error)
+				}
+			} else if result.Skipped {
+				stats.skipped++
+				printSkipped(result.SourceImage + " -> " + result.DestinationImage)
+			} else {
+				stats.success++
+				if result.Resumed {
+					printResumed(result.SourceImage + " -> " + result.DestinationImage)
+				} else if verboseLevel > 0 {
+					fmt.Printf("✅ %s SUCCÈS  ", phase)
+					if result.SourceImage != "" {
+						fmt.Printf("%s", result.SourceImage)
+					}
+					if result.DestinationImage != "" {
+						fmt.Printf(" -> %s", result.DestinationImage)
+					}
+					if result.Referrers > 0 {
+						fmt.Printf(" (+%d artefacts attachés)", result.Referrers)
+					}
+					fmt.Println(retriesLabel(result.Retries))
+				}
+			}
+			counters[phase] = stats
+		}
+
+		// Afficher le résumé du bloc
+		fmt.Printf("\nRésumé du transfert%s :\n", blockLabel(i, len(config.Blocks)))
+
+		for _, phase := range []internal.TransferPhase{
+			internal.PhaseExport,
+			internal.PhaseConvert,
+			internal.PhaseImport,
+			internal.PhaseCopy,
+		} {
+			stats := counters[phase]
+			if stats.total > 0 {
+				fmt.Printf("\nPhase %s :\n", phase)
+				fmt.Printf("  Total :      %d\n", stats.total)
+				fmt.Printf("  Réussites :    %d\n", stats.success)
+				if stats.skipped > 0 {
+					fmt.Printf("  Déjà à jour : %d\n", stats.skipped)
+				}
+				fmt.Printf("  Échecs :     %d\n", stats.failures)
+				totalFailures += stats.failures
 			}
 		}
-		counters[phase] = stats
 	}
 
-	// Afficher le résumé
-	fmt.Printf("\nRésumé du transfert :\n")
-	var totalFailures int
+	if authErr != nil {
+		return fmt.Errorf("le transfert s'est terminé avec %d échecs au total : %w", totalFailures, authErr)
+	}
+	if totalFailures > 0 {
+		return fmt.Errorf("le transfert s'est terminé avec %d échecs au total", totalFailures)
+	}
+	removeJournal(journal)
 
-	for _, phase := range []internal.TransferPhase{
-		internal.PhaseExport,
-		internal.PhaseConvert,
-		internal.PhaseImport,
-	} {
-		stats := counters[phase]
-		if stats.total > 0 {
-			fmt.Printf("\nPhase %s :\n", phase)
-			fmt.Printf("  Total :      %d\n", stats.total)
-			fmt.Printf("  Réussites :    %d\n", stats.success)
-			fmt.Printf("  Échecs :     %d\n", stats.failures)
-			totalFailures += stats.failures
+	return nil
+}
+
+func handleSync(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Plateformes conservées des index multi-plateformes
+	platformFilter, err := internal.ParsePlatforms(platforms)
+	if err != nil {
+		return err
+	}
+
+	// Politique de nouvelles tentatives
+	retry, err := retryPolicy()
+	if err != nil {
+		return err
+	}
+
+	var totalFailures, totalStale int
+	var authErr *internal.AuthError
+
+	for i, block := range config.Blocks {
+		printBlockHeader(i, len(config.Blocks), block)
+
+		// Créer les options de synchronisation
+		options := internal.SyncOptions{
+			VerboseLevel: verboseLevel,
+			KeepGoing:    keepGoing,
+			Prune:        prune,
+			Force:        force,
+			Platforms:    platformFilter,
+			TLS:          tlsOptions,
+			Jobs:         jobs,
+			MaxConns:     maxConns,
+			Retry:        retry,
 		}
+
+		// Créer le gestionnaire de synchronisation
+		handler := internal.NewSyncHandler(cmd.Context(), options, session)
+
+		// Démarrer la synchronisation
+		results := handler.SyncImages(block)
+
+		// Compteurs pour le suivi
+		var copied, skipped, stale, pruned, failures int
+
+		// Traiter les résultats
+		for result := range results {
+			switch {
+			case result.Error != nil:
+				failures++
+				errors.As(result.Error, &authErr)
+				fmt.Printf("❌ %s ÉCHEC  ", result.Phase)
+				if result.SourceImage != "" {
+					fmt.Printf("%s -> ", result.SourceImage)
+				}
+				fmt.Printf("%s%s\n", result.DestinationImage, retriesLabel(result.Retries))
+				if verboseLevel > 0 {
+					fmt.Printf("   Erreur : %v\n", result.Error)
+				}
+			case result.Phase == internal.PhasePrune && prune:
+				pruned++
+				fmt.Printf("🗑️  SUPPRIMÉ %s%s\n", result.DestinationImage, retriesLabel(result.Retries))
+			case result.Phase == internal.PhasePrune:
+				stale++
+				fmt.Printf("⚠️  OBSOLÈTE %s (absent de la source, voir --prune)\n", result.DestinationImage)
+			case result.Skipped:
+				skipped++
+				printSkipped(result.SourceImage + " -> " + result.DestinationImage)
+			default:
+				copied++
+				if verboseLevel > 0 {
+					fmt.Printf("✅ SUCCÈS %s -> %s", result.SourceImage, result.DestinationImage)
+					if result.Referrers > 0 {
+						fmt.Printf(" (+%d artefacts attachés)", result.Referrers)
+					}
+					fmt.Println(retriesLabel(result.Retries))
+				}
+			}
+		}
+
+		// Afficher le résumé du bloc
+		fmt.Printf("\nRésumé de la synchronisation%s :\n", blockLabel(i, len(config.Blocks)))
+		fmt.Printf("Copiés :       %d\n", copied)
+		fmt.Printf("Déjà à jour :  %d\n", skipped)
+		if prune {
+			fmt.Printf("Supprimés :    %d\n", pruned)
+		} else {
+			fmt.Printf("Obsolètes :    %d\n", stale)
+		}
+		fmt.Printf("Échecs :        %d\n", failures)
+		totalFailures += failures
+		totalStale += stale
 	}
 
+	if totalStale > 0 {
+		fmt.Printf("\n%d tags de destination absents de la source ont été conservés ; relancer avec --prune pour les supprimer\n", totalStale)
+	}
+
+	if authErr != nil {
+		return fmt.Errorf("la synchronisation s'est terminée avec %d échecs au total : %w", totalFailures, authErr)
+	}
 	if totalFailures > 0 {
-		return fmt.Errorf("le transfert s'est terminé avec %d échecs au total", totalFailures)
+		return fmt.Errorf("la synchronisation s'est terminée avec %d échecs au total", totalFailures)
 	}
 
 	return nil
 }
 
 func handleValidate(cmd *cobra.Command, args []string) error {
+	if cfgFile == "" {
+		return fmt.Errorf("le flag --config est obligatoire")
+	}
+
 	config, err := internal.ParseConfig(cfgFile)
 	if err != nil {
 		return fmt.Errorf("échec de la validation : %w", err)
 	}
 
-	if len(config.Blocks) != 1 {
-		return fmt.Errorf("la configuration doit contenir exactement un bloc, trouvé %d", len(config.Blocks))
+	if len(config.Blocks) == 0 {
+		return fmt.Errorf("la configuration ne contient aucun bloc")
 	}
 
-	block := config.Blocks[0]
+	for i, block := range config.Blocks {
+		if block.SourceRegistry.Host == "" && block.DestinationRegistry.Host == "" {
+			return fmt.Errorf("bloc %d : au moins un registre doit être spécifié", i+1)
+		}
 
-	// Vérifier que le protocole est spécifié
-	if !strings.HasPrefix(block.SourceRegistry.Host, "http://") &&
-		!strings.HasPrefix(block.SourceRegistry.Host, "https://") {
-		return fmt.Errorf("l'URL du registre source doit spécifier le protocole (http:// ou https://)")
-	}
+		// Vérifier que le protocole est spécifié
+		if block.SourceRegistry.Host != "" && block.SourceRegistry.Scheme == "" {
+			return fmt.Errorf("bloc %d : l'URL du registre source doit spécifier le protocole (http:// ou https://)", i+1)
+		}
 
-	if block.DestinationRegistry.Host != "" {
-		if !strings.HasPrefix(block.DestinationRegistry.Host, "http://") &&
-			!strings.HasPrefix(block.DestinationRegistry.Host, "https://") {
-			return fmt.Errorf("l'URL du registre de destination doit spécifier le protocole (http:// ou https://)")
+		if block.DestinationRegistry.Host != "" && block.DestinationRegistry.Scheme == "" {
+			return fmt.Errorf("bloc %d : l'URL du registre de destination doit spécifier le protocole (http:// ou https://)", i+1)
 		}
 	}
 
 	fmt.Printf("✅ La configuration est valide !\n\n")
-	fmt.Printf("Registre source :      %s\n", block.SourceRegistry.Host)
-	if block.DestinationRegistry.Host != "" {
-		fmt.Printf("Registre de destination : %s\n", block.DestinationRegistry.Host)
+	fmt.Printf("Nombre de blocs :     %d\n", len(config.Blocks))
+
+	for i, block := range config.Blocks {
+		printBlockHeader(i, len(config.Blocks), block)
+		if block.SourceRegistry.Host != "" {
+			fmt.Printf("Registre source :      %s%s\n", block.SourceRegistry.URL(), insecureLabel(block.SourceRegistry))
+		}
+		if block.DestinationRegistry.Host != "" {
+			fmt.Printf("Registre de destination : %s%s\n", block.DestinationRegistry.URL(), insecureLabel(block.DestinationRegistry))
+		}
+		fmt.Printf("Nombre d'images :     %d\n", len(block.ImageMappings))
+		if len(block.Exclusions) > 0 {
+			fmt.Printf("Exclusions :          %d\n", len(block.Exclusions))
+		}
+
+		// Références résolues contre les registres du bloc
+		fmt.Printf("\nImages :\n")
+		for _, mapping := range block.ImageMappings {
+			fmt.Printf("  %s -> %s\n", block.SourceRegistry.Qualify(mapping.Source), block.DestinationRegistry.Qualify(mapping.Destination))
+		}
 	}
-	fmt.Printf("Nombre d'images :     %d\n", len(block.ImageMappings))
-	if len(block.Exclusions) > 0 {
-		fmt.Printf("Exclusions :          %d\n", len(block.Exclusions))
+
+	return nil
+}
+
+func handleLogin(cmd *cobra.Command, args []string) error {
+	switch {
+	case listLogins:
+		if len(args) > 0 {
+			return fmt.Errorf("--list n'accepte aucun registre")
+		}
+		return listStoredLogins()
+	case testLogins:
+		return testStoredLogins(cmd, args)
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("un registre est attendu, par exemple : magina login https://registry.example.com")
+	}
+
+	registry, err := internal.ParseRegistry(args[0])
+	if err != nil {
+		return err
+	}
+
+	role, err := internal.ParseRole(loginRole)
+	if err != nil {
+		return err
 	}
 
+	// Identifiants des flags, sinon saisis par l'utilisateur
+	creds, err := credentials.resolve()
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		if nonInteractive {
+			return &internal.AuthError{Registry: registry.Host, Reason: "no credentials given and non-interactive mode is enabled"}
+		}
+		if creds, err = internal.PromptCredentials(entryLabel(registry.Host, role)); err != nil {
+			return err
+		}
+	}
+
+	if !noVerify {
+		if err := internal.VerifyCredentials(cmd.Context(), registry, creds, tlsOptions); err != nil {
+			return fmt.Errorf("identifiants refusés, rien n'a été enregistré : %w", err)
+		}
+	}
+
+	if err := credStore.Put(registry.Host, role, creds); err != nil {
+		return fmt.Errorf("échec de l'enregistrement des identifiants : %w", err)
+	}
+
+	fmt.Printf("✅ Identifiants enregistrés pour %s (%s)\n", entryLabel(registry.Host, role), credentialLabel(creds.Username, creds.TokenType()))
 	return nil
 }
+
+// listStoredLogins affiche les registres du magasin d'identifiants, sans les mots de passe
+func listStoredLogins() error {
+	if !credStore.Exists() {
+		fmt.Println("Aucun identifiant enregistré")
+		return nil
+	}
+
+	entries, err := credStore.List()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("Aucun identifiant enregistré")
+		return nil
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\n", entryLabel(entry.Registry, entry.Role), credentialLabel(entry.Username, entry.TokenType))
+	}
+	return nil
+}
+
+// testStoredLogins vérifie les identifiants enregistrés auprès de leurs registres
+func testStoredLogins(cmd *cobra.Command, args []string) error {
+	if !credStore.Exists() {
+		return fmt.Errorf("aucun identifiant enregistré")
+	}
+
+	role, err := internal.ParseRole(loginRole)
+	if err != nil {
+		return err
+	}
+
+	// Registres donnés pour le rôle choisi, sinon toutes les entrées enregistrées
+	var targets []internal.StoredEntry
+	for _, arg := range args {
+		targets = append(targets, internal.StoredEntry{Registry: arg, Role: role})
+	}
+	if len(targets) == 0 {
+		if targets, err = credStore.List(); err != nil {
+			return err
+		}
+	}
+
+	var failures int
+	for _, target := range targets {
+		registry, err := internal.ParseRegistry(target.Registry)
+		if err != nil {
+			return err
+		}
+		label := entryLabel(registry.Host, target.Role)
+
+		creds, err := credStore.Get(registry.Host, target.Role)
+		if err != nil {
+			return err
+		}
+		if creds == nil {
+			failures++
+			fmt.Printf("❌ ÉCHEC  %s : aucun identifiant enregistré\n", label)
+			continue
+		}
+
+		if err := internal.VerifyCredentials(cmd.Context(), registry, creds, tlsOptions); err != nil {
+			failures++
+			fmt.Printf("❌ ÉCHEC  %s : %v\n", label, err)
+			continue
+		}
+
+		fmt.Printf("✅ SUCCÈS %s (%s)\n", label, credentialLabel(creds.Username, creds.TokenType()))
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d registres ont refusé les identifiants enregistrés", failures)
+	}
+	return nil
+}
+
+func handleLogout(cmd *cobra.Command, args []string) error {
+	if logoutAll {
+		if len(args) > 0 {
+			return fmt.Errorf("--all n'accepte aucun registre")
+		}
+		if err := credStore.Clear(); err != nil {
+			return err
+		}
+		fmt.Println("✅ Tous les identifiants enregistrés ont été supprimés")
+		return nil
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("un registre est attendu, ou --all")
+	}
+
+	registry, err := internal.ParseRegistry(args[0])
+	if err != nil {
+		return err
+	}
+
+	role, err := internal.ParseRole(loginRole)
+	if err != nil {
+		return err
+	}
+	label := entryLabel(registry.Host, role)
+
+	if !credStore.Exists() {
+		fmt.Printf("Aucun identifiant enregistré pour %s\n", label)
+		return nil
+	}
+
+	removed, err := credStore.Delete(registry.Host, role)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		fmt.Printf("Aucun identifiant enregistré pour %s\n", label)
+		return nil
+	}
+
+	fmt.Printf("✅ Identifiants supprimés pour %s\n", label)
+	return nil
+}
+
+// entryLabel désigne une entrée du magasin d'identifiants, avec son rôle éventuel
+func entryLabel(registry string, role internal.Role) string {
+	if role == "" {
+		return registry
+	}
+	return fmt.Sprintf("%s (%s)", registry, role)
+}
+
+// openCredentialStore prépare le magasin d'identifiants et le transmet à la session.
+// Il n'est déchiffré qu'à la première lecture.
+func openCredentialStore() error {
+	store, err := internal.NewCredentialStore(credStorePath, keyFile)
+	if err != nil {
+		return err
+	}
+
+	credStore = store
+	session.SetCredentialStore(store)
+	return nil
+}
+
+// setCredentialProvider transmet à la session le fournisseur d'identifiants externe
+func setCredentialProvider() error {
+	if providerCmd == "" {
+		providerCmd = os.Getenv(internal.CredentialProviderEnv)
+	}
+	if providerCmd == "" {
+		return nil
+	}
+
+	provider, err := internal.NewCredentialProvider(providerCmd)
+	if err != nil {
+		return err
+	}
+
+	session.SetCredentialProvider(provider)
+	return nil
+}
+
+// setPullSecrets transmet à la session les identifiants des secrets Kubernetes
+func setPullSecrets() error {
+	if len(pullSecrets) == 0 {
+		return nil
+	}
+
+	keychain, err := internal.LoadPullSecrets(pullSecrets)
+	if err != nil {
+		return err
+	}
+
+	session.SetPullSecrets(keychain)
+	return nil
+}
+
+// credentialFlags regroupe les flags d'identification d'un rôle
+type credentialFlags struct {
+	prefix        string
+	username      string
+	password      string
+	passwordStdin bool
+	token         string
+	tokenFile     string
+	tokenStdin    bool
+	tokenType     string
+}
+
+// register déclare les flags d'identification sur une commande
+func (f *credentialFlags) register(cmd *cobra.Command, prefix, target string) {
+	f.prefix = prefix
+	cmd.Flags().StringVar(&f.username, prefix+"username", "", "Nom d'utilisateur pour "+target)
+	cmd.Flags().StringVar(&f.password, prefix+"password", "", "Mot de passe pour "+target)
+	cmd.Flags().BoolVar(&f.passwordStdin, prefix+"password-stdin", false, "Lire le mot de passe pour "+target+" depuis l'entrée standard")
+	cmd.Flags().StringVar(&f.token, prefix+"token", "", "Jeton pour "+target+" (voir --"+prefix+"token-type)")
+	cmd.Flags().StringVar(&f.tokenFile, prefix+"token-file", "", "Lire le jeton pour "+target+" depuis un fichier")
+	cmd.Flags().BoolVar(&f.tokenStdin, prefix+"token-stdin", false, "Lire le jeton pour "+target+" depuis l'entrée standard")
+	cmd.Flags().StringVar(&f.tokenType, prefix+"token-type", string(internal.TokenBearer), "Type du jeton pour "+target+" : bearer (jeton du registre) ou identity (jeton de rafraîchissement OAuth2)")
+}
+
+// readsStdin indique si les flags lisent un secret depuis l'entrée standard
+func (f *credentialFlags) readsStdin() bool {
+	return f.passwordStdin || f.tokenStdin
+}
+
+// resolve construit les identifiants à partir des flags, nil si aucun n'est donné
+func (f *credentialFlags) resolve() (*internal.Credentials, error) {
+	tokenSources := 0
+	for _, given := range []bool{f.token != "", f.tokenFile != "", f.tokenStdin} {
+		if given {
+			tokenSources++
+		}
+	}
+
+	if f.username == "" && f.password == "" && !f.passwordStdin && tokenSources == 0 {
+		return nil, nil
+	}
+
+	// Jeton, accompagné ou non d'un nom d'utilisateur
+	if tokenSources > 0 {
+		return f.resolveToken(tokenSources)
+	}
+
+	if f.username == "" {
+		return nil, fmt.Errorf("--%susername est obligatoire avec un mot de passe", f.prefix)
+	}
+	if f.password != "" && f.passwordStdin {
+		return nil, fmt.Errorf("--%spassword et --%spassword-stdin sont incompatibles", f.prefix, f.prefix)
+	}
+
+	password := f.password
+	if f.passwordStdin {
+		var err error
+		if password, err = internal.ReadPassword(os.Stdin); err != nil {
+			return nil, err
+		}
+	}
+	if password == "" {
+		return nil, fmt.Errorf("--%susername nécessite --%spassword, --%spassword-stdin ou un jeton", f.prefix, f.prefix, f.prefix)
+	}
+
+	return internal.NewCredentials(f.username, password), nil
+}
+
+// resolveToken construit des identifiants à partir du jeton donné en ligne de commande
+func (f *credentialFlags) resolveToken(sources int) (*internal.Credentials, error) {
+	if sources > 1 {
+		return nil, fmt.Errorf("--%stoken, --%stoken-file et --%stoken-stdin sont incompatibles", f.prefix, f.prefix, f.prefix)
+	}
+	if f.password != "" || f.passwordStdin {
+		return nil, fmt.Errorf("un jeton et un mot de passe ne peuvent pas être donnés ensemble")
+	}
+
+	tokenType, err := internal.ParseTokenType(f.tokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	token := f.token
+	switch {
+	case f.tokenFile != "":
+		token, err = internal.ReadTokenFile(f.tokenFile)
+	case f.tokenStdin:
+		token, err = internal.ReadToken(os.Stdin)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.NewTokenCredentials(f.username, token, tokenType), nil
+}
+
+// credentialLabel décrit des identifiants sans révéler le secret
+func credentialLabel(username string, tokenType internal.TokenType) string {
+	switch {
+	case tokenType == "":
+		return username
+	case username == "":
+		return fmt.Sprintf("jeton %s", tokenType)
+	default:
+		return fmt.Sprintf("%s, jeton %s", username, tokenType)
+	}
+}
+
+// setExplicitCredentials transmet à la session les identifiants donnés en ligne de commande
+func setExplicitCredentials() error {
+	session.SetNonInteractive(nonInteractive)
+
+	// L'entrée standard ne peut être lue qu'une fois
+	stdinReaders := 0
+	for _, flags := range []*credentialFlags{&credentials, &srcCredentials, &dstCredentials} {
+		if flags.readsStdin() {
+			stdinReaders++
+		}
+	}
+	if stdinReaders > 1 {
+		return fmt.Errorf("un seul flag --*password-stdin ou --*token-stdin peut être utilisé")
+	}
+
+	common, err := credentials.resolve()
+	if err != nil {
+		return err
+	}
+
+	for role, flags := range map[internal.Role]*credentialFlags{
+		internal.RoleSource:      &srcCredentials,
+		internal.RoleDestination: &dstCredentials,
+	} {
+		creds, err := flags.resolve()
+		if err != nil {
+			return err
+		}
+		if creds == nil {
+			creds = common
+		}
+		if creds != nil {
+			session.SetExplicitCredentials(role, creds)
+		}
+	}
+
+	return nil
+}
+
+// loadConfig analyse la configuration BRMS et vérifie qu'elle contient au moins un bloc
+func loadConfig() (*internal.Config, error) {
+	if cfgFile == "" {
+		return nil, fmt.Errorf("le flag --config est obligatoire")
+	}
+
+	config, err := internal.ParseConfig(cfgFile)
+	if err != nil {
+		return nil, fmt.Errorf("échec de l'analyse de la configuration : %w", err)
+	}
+
+	if len(config.Blocks) == 0 {
+		return nil, fmt.Errorf("la configuration ne contient aucun bloc")
+	}
+
+	return config, nil
+}
+
+// newRollback crée le suivi des artefacts écrits lorsque --clean-on-error est demandé
+func newRollback() *internal.Rollback {
+	if !cleanOnError {
+		return nil
+	}
+	return internal.NewRollback()
+}
+
+// cleanUp annule les artefacts écrits par une exécution en échec et affiche
+// ce qui a été nettoyé
+func cleanUp(ctx context.Context, rollback *internal.Rollback) {
+	if rollback.Len() == 0 {
+		return
+	}
+
+	fmt.Printf("\nNettoyage après échec (%d artefacts) :\n", rollback.Len())
+
+	// L'exécution a pu être interrompue : le nettoyage doit aboutir malgré tout
+	for _, result := range rollback.Undo(context.WithoutCancel(ctx)) {
+		switch {
+		case result.Error != nil:
+			fmt.Printf("❌ ÉCHEC    %s : %v\n", result.Artifact, result.Error)
+		case result.Action == internal.CleanupRestored:
+			fmt.Printf("↩️  RESTAURÉ %s\n", result.Artifact)
+		default:
+			fmt.Printf("🧹 SUPPRIMÉ %s\n", result.Artifact)
+		}
+	}
+}
+
+// openJournal ouvre le journal de reprise du fichier de configuration pour les
+// phases données. Sans --resume, les entrées de ces phases laissées par une
+// exécution précédente sont ignorées puis remplacées ; celles des autres
+// phases sont conservées.
+func openJournal(phases ...internal.TransferPhase) (*internal.Journal, error) {
+	path, err := internal.JournalPath(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return openJournalAt(path, phases)
+}
+
+// openBundleJournal ouvre le journal de reprise d'une importation depuis un
+// bundle seul
+func openBundleJournal(bundle *internal.BundleIndex, phases ...internal.TransferPhase) (*internal.Journal, error) {
+	path, err := internal.BundleJournalPath(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return openJournalAt(path, phases)
+}
+
+// openJournalAt ouvre le journal de reprise à l'emplacement donné
+func openJournalAt(path string, phases []internal.TransferPhase) (*internal.Journal, error) {
+	journal, err := internal.OpenJournal(path, resume, phases...)
+	if err != nil {
+		return nil, fmt.Errorf("échec de l'ouverture du journal de reprise : %w", err)
+	}
+
+	if resume {
+		if count := journal.Len(); count > 0 {
+			fmt.Printf("Reprise : %d opérations déjà effectuées d'après %s\n", count, path)
+		} else {
+			fmt.Println("Reprise : aucune exécution interrompue, démarrage depuis le début")
+		}
+	}
+
+	return journal, nil
+}
+
+// removeJournal retire du journal de reprise les entrées d'une exécution
+// terminée sans échec, le fichier n'étant supprimé qu'une fois vide
+func removeJournal(journal *internal.Journal) {
+	if err := journal.Remove(); err != nil {
+		fmt.Fprintf(os.Stderr, "Avertissement : %v\n", err)
+	}
+}
+
+// printResumed signale une image déjà traitée par une exécution interrompue
+func printResumed(image string) {
+	if verboseLevel > 0 {
+		fmt.Printf("⏩ DÉJÀ FAIT %s\n", image)
+	}
+}
+
+// printSkipped signale une image dont le tag de destination pointe déjà sur
+// le même manifeste
+func printSkipped(image string) {
+	if verboseLevel > 0 {
+		fmt.Printf("⏭️  IGNORÉ %s (déjà à jour)\n", image)
+	}
+}
+
+// retryPolicy construit la politique de nouvelles tentatives à partir des flags
+func retryPolicy() (internal.RetryPolicy, error) {
+	if retries < 1 {
+		return internal.RetryPolicy{}, fmt.Errorf("--retries doit valoir au moins 1")
+	}
+	if retryBackoff < 0 || retryMaxWait < 0 {
+		return internal.RetryPolicy{}, fmt.Errorf("les délais entre tentatives ne peuvent pas être négatifs")
+	}
+	for host, attempts := range hostRetries {
+		if attempts < 1 {
+			return internal.RetryPolicy{}, fmt.Errorf("--registry-retries %s doit valoir au moins 1", host)
+		}
+	}
+
+	return internal.RetryPolicy{
+		MaxAttempts: retries,
+		Backoff:     retryBackoff,
+		MaxBackoff:  retryMaxWait,
+		Hosts:       hostRetries,
+	}, nil
+}
+
+// retriesLabel signale les nouvelles tentatives faites pour une image
+func retriesLabel(retries int) string {
+	switch retries {
+	case 0:
+		return ""
+	case 1:
+		return " (1 nouvelle tentative)"
+	default:
+		return fmt.Sprintf(" (%d nouvelles tentatives)", retries)
+	}
+}
+
+// blockLabel retourne le suffixe identifiant un bloc dans les résumés,
+// vide lorsque la configuration ne contient qu'un bloc
+func blockLabel(index, count int) string {
+	if count == 1 {
+		return ""
+	}
+	return fmt.Sprintf(" (bloc %d/%d)", index+1, count)
+}
+
+// printBlockHeader affiche l'en-tête d'un bloc lorsque la configuration en contient plusieurs
+func printBlockHeader(index, count int, block *internal.Block) {
+	if count == 1 {
+		return
+	}
+	fmt.Printf("\n=== Bloc %d/%d : [%s|%s] ===\n", index+1, count, block.SourceRegistry.URL(), block.DestinationRegistry.URL())
+}
+
+// insecureLabel signale un registre joint en HTTP non chiffré
+func insecureLabel(registry internal.Registry) string {
+	if registry.Insecure() {
+		return " (HTTP non chiffré)"
+	}
+	return ""
+}
+
+// printSummary affiche le résumé d'une opération pour un bloc
+func printSummary(operation string, index, count, total, success, skipped, failures int) {
+	fmt.Printf("\nRésumé %s%s :\n", operation, blockLabel(index, count))
+	fmt.Printf("Total des images :  %d\n", total)
+	fmt.Printf("Réussites :    %d\n", success)
+	if skipped > 0 {
+		fmt.Printf("Déjà à jour :  %d\n", skipped)
+	}
+	fmt.Printf("Échecs :        %d\n", failures)
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// blobFetcher opens a blob referenced by a manifest
+type blobFetcher func(v1.Descriptor) (io.ReadCloser, error)
+
+// rawArtifact is a manifest copied byte for byte, without interpreting the
+// media types of its config and layers, with a way to read the blobs it references
+type rawArtifact struct {
+	desc     v1.Descriptor
+	raw      []byte
+	manifest *v1.Manifest
+	fetch    blobFetcher
+	origin   *name.Repository // Registry repository of the blobs, nil for the local store
+}
+
+// RawManifest returns the manifest as received
+func (a *rawArtifact) RawManifest() ([]byte, error) {
+	return a.raw, nil
+}
+
+// MediaType returns the media type of the manifest
+func (a *rawArtifact) MediaType() (types.MediaType, error) {
+	return a.desc.MediaType, nil
+}
+
+// Blobs returns the config and layer descriptors of the manifest
+func (a *rawArtifact) Blobs() []v1.Descriptor {
+	return append([]v1.Descriptor{a.manifest.Config}, a.manifest.Layers...)
+}
+
+// newRemoteArtifact wraps a manifest fetched from a registry. Blobs are read
+// from the same repository.
+func newRemoteArtifact(repo name.Repository, descriptor *remote.Descriptor, opts []remote.Option) (*rawArtifact, error) {
+	manifest, err := v1.ParseManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", descriptor.Digest, err)
+	}
+
+	desc := descriptor.Descriptor
+	desc.ArtifactType = artifactType(descriptor.Manifest, manifest)
+
+	return &rawArtifact{
+		desc:     desc,
+		raw:      descriptor.Manifest,
+		manifest: manifest,
+		origin:   &repo,
+		fetch: func(blob v1.Descriptor) (io.ReadCloser, error) {
+			layer, err := remote.Layer(repo.Digest(blob.Digest.String()), opts...)
+			if err != nil {
+				return nil, err
+			}
+			return layer.Compressed()
+		},
+	}, nil
+}
+
+// pushArtifact uploads the blobs of an artifact, then its manifest, unchanged.
+// Blobs of an artifact read from another repository of the same registry are
+// mounted rather than uploaded.
+func pushArtifact(ref name.Reference, artifact *rawArtifact, opts []remote.Option) error {
+	for _, blob := range artifact.Blobs() {
+		layer, err := partial.CompressedToLayer(&artifactBlob{desc: blob, fetch: artifact.fetch})
+		if err != nil {
+			return err
+		}
+		if artifact.origin != nil {
+			layer = &remote.MountableLayer{Layer: layer, Reference: artifact.origin.Digest(blob.Digest.String())}
+		}
+		if err := remote.WriteLayer(ref.Context(), layer, opts...); err != nil {
+			return fmt.Errorf("failed to push blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	return remote.Put(ref, artifact, opts...)
+}
+
+// artifactBlob exposes an artifact blob as a compressed layer for upload
+type artifactBlob struct {
+	desc  v1.Descriptor
+	fetch blobFetcher
+}
+
+func (b *artifactBlob) Digest() (v1.Hash, error)            { return b.desc.Digest, nil }
+func (b *artifactBlob) Size() (int64, error)                { return b.desc.Size, nil }
+func (b *artifactBlob) MediaType() (types.MediaType, error) { return b.desc.MediaType, nil }
+func (b *artifactBlob) Compressed() (io.ReadCloser, error)  { return b.fetch(b.desc) }
+
+// isArtifact reports whether a fetched manifest is an OCI artifact (Helm
+// chart, WASM module, signature…) rather than a container image. Artifacts
+// are copied descriptor by descriptor so that unknown media types are kept.
+func isArtifact(descriptor *remote.Descriptor) bool {
+	switch descriptor.MediaType {
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+	default:
+		return !descriptor.MediaType.IsIndex() && !descriptor.MediaType.IsSchema1()
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return false
+	}
+
+	if declaredArtifactType(descriptor.Manifest) != "" {
+		return true
+	}
+
+	switch manifest.Config.MediaType {
+	case types.OCIConfigJSON, types.DockerConfigJSON:
+		return false
+	default:
+		return true
+	}
+}
+
+// artifactType returns the type of an artifact manifest, falling back to the
+// config media type as the OCI image spec recommends
+func artifactType(raw []byte, manifest *v1.Manifest) string {
+	if declared := declaredArtifactType(raw); declared != "" {
+		return declared
+	}
+	return string(manifest.Config.MediaType)
+}
+
+// declaredArtifactType reads the artifactType field of a manifest, which
+// v1.Manifest does not model
+func declaredArtifactType(raw []byte) string {
+	var fields struct {
+		ArtifactType string `json:"artifactType"`
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+	return fields.ArtifactType
+}
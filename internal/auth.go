@@ -2,19 +2,137 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"syscall"
+	"time"
 	"encoding/base64"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
 	"golang.org/x/term"
 )
 
 // Credentials represents authentication credentials for a registry
 type Credentials struct {
-	Username string
-	Password string
-	Auth     string // Base64 encoded string of "username:password"
+	Username      string
+	Password      string
+	Auth          string    // Base64 encoded string of "username:password"
+	IdentityToken string    // OAuth2 refresh token, exchanged for registry tokens
+	RegistryToken string    // Pre-issued bearer token, sent as is
+	ExpiresAt     time.Time // Zero when the credentials do not expire
+}
+
+// TokenType tells how a token is presented to a registry
+type TokenType string
+
+const (
+	// TokenBearer is a pre-issued registry token sent in the Authorization header
+	TokenBearer TokenType = "bearer"
+	// TokenIdentity is an OAuth2 refresh token exchanged at the registry's
+	// token endpoint, as issued by Azure, GitLab or Harbor
+	TokenIdentity TokenType = "identity"
+)
+
+// ParseTokenType parses a token type given on the command line
+func ParseTokenType(value string) (TokenType, error) {
+	switch TokenType(strings.ToLower(value)) {
+	case "", TokenBearer:
+		return TokenBearer, nil
+	case TokenIdentity:
+		return TokenIdentity, nil
+	default:
+		return "", fmt.Errorf("invalid token type %q: expected %s or %s", value, TokenBearer, TokenIdentity)
+	}
+}
+
+// NewCredentials creates username and password credentials
+func NewCredentials(username, password string) *Credentials {
+	return &Credentials{
+		Username: username,
+		Password: password,
+		Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	}
+}
+
+// NewTokenCredentials creates token credentials. The username is optional;
+// some token endpoints expect it alongside an identity token.
+func NewTokenCredentials(username, token string, tokenType TokenType) *Credentials {
+	creds := &Credentials{Username: username}
+	if tokenType == TokenIdentity {
+		creds.IdentityToken = token
+	} else {
+		creds.RegistryToken = token
+	}
+	return creds
+}
+
+// TokenType returns the type of token the credentials hold, or an empty
+// string for username and password credentials
+func (c *Credentials) TokenType() TokenType {
+	switch {
+	case c.RegistryToken != "":
+		return TokenBearer
+	case c.IdentityToken != "":
+		return TokenIdentity
+	default:
+		return ""
+	}
+}
+
+// Expired reports whether the credentials expire within the renewal margin
+func (c *Credentials) Expired() bool {
+	return !c.ExpiresAt.IsZero() && time.Now().Add(expiryMargin).After(c.ExpiresAt)
+}
+
+// AuthConfig returns the credentials in the form used by go-containerregistry
+func (c *Credentials) AuthConfig() authn.AuthConfig {
+	return authn.AuthConfig{
+		Username:      c.Username,
+		Password:      c.Password,
+		Auth:          c.Auth,
+		IdentityToken: c.IdentityToken,
+		RegistryToken: c.RegistryToken,
+	}
+}
+
+// ReadPassword reads a password from a reader, such as stdin for
+// --password-stdin, trimming the trailing newline
+func ReadPassword(r io.Reader) (string, error) {
+	return readSecret(r, "password")
+}
+
+// ReadToken reads a token from a reader, such as stdin for --token-stdin,
+// trimming the trailing newline
+func ReadToken(r io.Reader) (string, error) {
+	return readSecret(r, "token")
+}
+
+// ReadTokenFile reads a token from a file, such as a mounted secret
+func ReadTokenFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer file.Close()
+
+	return readSecret(file, "token")
+}
+
+// readSecret reads a secret from a reader, trimming the trailing newline
+func readSecret(r io.Reader, what string) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", what, err)
+	}
+
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("empty %s", what)
+	}
+
+	return secret, nil
 }
 
 // AuthHandler handles authentication for registries
@@ -56,19 +174,64 @@ func (h *AuthHandler) GetCredentials(registryURL string) (*Credentials, error) {
 
 // getCredsFromEnv attempts to retrieve credentials from environment variables
 func (h *AuthHandler) getCredsFromEnv(registryURL string) (*Credentials, error) {
+	return credentialsFromEnv(registryURL)
+}
+
+// credentialsFromEnv retrieves credentials from the <HOST>_USERNAME and
+// <HOST>_PASSWORD environment variables, e.g. REGISTRY_COMPANY_COM_USERNAME,
+// or from a <HOST>_TOKEN bearer token or <HOST>_IDENTITY_TOKEN refresh token
+func credentialsFromEnv(registryURL string) (*Credentials, error) {
+	return credentialsFromEnvPrefix(envPrefix(registryURL))
+}
+
+// roleCredentialsFromEnv retrieves the credentials of a role from the
+// environment, from the most specific repository prefix down to the bare
+// host. At each level, variables with the role suffix, e.g.
+// HARBOR_EXAMPLE_COM_DST_USERNAME, win over the shared ones.
+func roleCredentialsFromEnv(role Role, registryURL string) (*Credentials, error) {
+	for _, scope := range credentialScopes(registryURL) {
+		prefix := envPrefix(scope)
+		if creds, err := credentialsFromEnvPrefix(prefix + "_" + role.envSuffix()); err == nil {
+			return creds, nil
+		}
+		if creds, err := credentialsFromEnvPrefix(prefix); err == nil {
+			return creds, nil
+		}
+	}
+
+	return nil, fmt.Errorf("credentials not found in environment")
+}
+
+// envPrefix turns a registry into the prefix of its environment variables
+func envPrefix(registryURL string) string {
 	// Clean the URL to create a valid prefix for environment variables
-	prefix := strings.NewReplacer(
+	return strings.NewReplacer(
 		"https://", "",
 		"http://", "",
 		".", "_",
 		"/", "_",
 		"-", "_",
+		":", "_",
 	).Replace(strings.ToUpper(registryURL))
+}
 
+// credentialsFromEnvPrefix retrieves credentials from the environment
+// variables sharing a prefix
+func credentialsFromEnvPrefix(prefix string) (*Credentials, error) {
 	// Look for environment variables
 	username := os.Getenv(prefix + "_USERNAME")
 	password := os.Getenv(prefix + "_PASSWORD")
 
+	// A token may come with a username but never with a password
+	if password == "" {
+		if token := os.Getenv(prefix + "_TOKEN"); token != "" {
+			return NewTokenCredentials(username, token, TokenBearer), nil
+		}
+		if token := os.Getenv(prefix + "_IDENTITY_TOKEN"); token != "" {
+			return NewTokenCredentials(username, token, TokenIdentity), nil
+		}
+	}
+
 	if username == "" || password == "" {
 		return nil, fmt.Errorf("credentials not found in environment")
 	}
@@ -82,6 +245,70 @@ func (h *AuthHandler) getCredsFromEnv(registryURL string) (*Credentials, error)
 	}, nil
 }
 
+// registryHost returns the host of a registry that may carry a repository
+// prefix, e.g. "harbor.example.com" for "harbor.example.com/project-a"
+func registryHost(registryURL string) string {
+	host, _, _ := strings.Cut(registryURL, "/")
+	return host
+}
+
+// credentialScopes returns a registry with its repository prefix, then each
+// shorter prefix down to the bare host
+func credentialScopes(registryURL string) []string {
+	scopes := []string{registryURL}
+	for i := strings.LastIndex(registryURL, "/"); i > 0; i = strings.LastIndex(registryURL[:i], "/") {
+		scopes = append(scopes, registryURL[:i])
+	}
+	return scopes
+}
+
+// credentialsFromDockerConfig retrieves credentials from the Docker config
+// (~/.docker/config.json or $DOCKER_CONFIG/config.json), including the
+// credsStore and credHelpers executables it names. It returns nil when the
+// config holds nothing for the registry.
+func credentialsFromDockerConfig(registryURL string) (*Credentials, error) {
+	creds, err := credentialsFromKeychain(authn.DefaultKeychain, registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Docker credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// credentialsFromKeychain resolves the credentials of a registry from a
+// go-containerregistry keychain. It returns nil when the keychain holds
+// nothing for the registry.
+func credentialsFromKeychain(keychain authn.Keychain, registryURL string) (*Credentials, error) {
+	// Keychains match on the registry host only
+	registry, err := name.NewRegistry(registryHost(registryURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry %s: %w", registryURL, err)
+	}
+
+	authenticator, err := keychain.Resolve(registry)
+	if err != nil {
+		return nil, err
+	}
+	if authenticator == authn.Anonymous {
+		return nil, nil
+	}
+
+	config, err := authenticator.Authorization()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials for %s: %w", registryURL, err)
+	}
+	if *config == (authn.AuthConfig{}) {
+		return nil, nil
+	}
+
+	return &Credentials{
+		Username:      config.Username,
+		Password:      config.Password,
+		Auth:          config.Auth,
+		IdentityToken: config.IdentityToken,
+		RegistryToken: config.RegistryToken,
+	}, nil
+}
+
 // promptCredentials prompts the user for credentials
 func (h *AuthHandler) promptCredentials(registryURL string) (*Credentials, error) {
 	fmt.Printf("Authentication required for %s\n", registryURL)
@@ -0,0 +1,503 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// BundleIndexVersion is the version of the bundle index format
+	BundleIndexVersion = 1
+
+	bundleIndexFile  = "magina.json"
+	bundleConfigFile = "config.brms"
+
+	// bundleIndexSuffix is appended to the bundle path to name the external index
+	bundleIndexSuffix = ".index.json"
+)
+
+// BundleIndex describes the content of an air-gap bundle
+type BundleIndex struct {
+	Version   int            `json:"version"`
+	ID        string         `json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Config    string         `json:"config"`
+	Base      *BundleBase    `json:"base,omitempty"`
+	Images    []BundleImage  `json:"images"`
+	Volumes   []BundleVolume `json:"volumes,omitempty"`
+
+	config []byte // BRMS file read from an extracted bundle
+}
+
+// BundleBase identifies the bundle a delta bundle was built on
+type BundleBase struct {
+	ID           string    `json:"id"`
+	CreatedAt    time.Time `json:"createdAt"`
+	SkippedBlobs int       `json:"skippedBlobs"`
+}
+
+// BundleOptions contains the options for writing a bundle
+type BundleOptions struct {
+	SplitSize int64        // Maximum volume size in bytes, no split if zero
+	Base      *BundleIndex // Previous bundle whose blobs are left out
+}
+
+// BundleImage describes an image mapping shipped in a bundle
+type BundleImage struct {
+	Source      string       `json:"source"`
+	Destination string       `json:"destination"`
+	Digest      string       `json:"digest"`
+	Blobs       []BundleBlob `json:"blobs"`
+}
+
+// BundleBlob describes a blob shipped in a bundle
+type BundleBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewBundleIndex creates an empty bundle index
+func NewBundleIndex() *BundleIndex {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &BundleIndex{
+		Version:   BundleIndexVersion,
+		ID:        hex.EncodeToString(id),
+		CreatedAt: time.Now().UTC(),
+		Config:    bundleConfigFile,
+		Images:    make([]BundleImage, 0),
+	}
+}
+
+// AddImage records an exported image mapping. The destination is the name
+// of the image in the store.
+func (b *BundleIndex) AddImage(source, destination, digest string) {
+	b.Images = append(b.Images, BundleImage{
+		Source:      source,
+		Destination: destination,
+		Digest:      digest,
+	})
+}
+
+// BlobSet returns the digests of every blob referenced by the bundle images
+func (b *BundleIndex) BlobSet() map[string]bool {
+	blobs := make(map[string]bool)
+	for _, image := range b.Images {
+		for _, blob := range image.Blobs {
+			blobs[blob.Digest] = true
+		}
+	}
+	return blobs
+}
+
+// WriteBundle writes the images recorded in the index, the OCI layout of the
+// store and a copy of the BRMS configuration into a tar archive. The bundle
+// index is also written next to the archive so it can serve as the base of a
+// later delta bundle.
+func WriteBundle(bundlePath string, store *Store, configPath string, index *BundleIndex, options BundleOptions) error {
+	// Blobs already shipped by the base bundle are left out
+	shipped := make(map[string]bool)
+	if options.Base != nil {
+		shipped = options.Base.BlobSet()
+		index.Base = &BundleBase{
+			ID:        options.Base.ID,
+			CreatedAt: options.Base.CreatedAt,
+		}
+	}
+
+	var out io.WriteCloser
+	var volumes *volumeWriter
+	if options.SplitSize > 0 {
+		volumes = newVolumeWriter(bundlePath, options.SplitSize)
+		out = volumes
+	} else {
+		file, err := os.Create(bundlePath)
+		if err != nil {
+			return fmt.Errorf("failed to create bundle: %w", err)
+		}
+		out = file
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+
+	// Layout marker first so the archive is a valid OCI layout
+	layoutFile, err := os.ReadFile(filepath.Join(store.Path(), "oci-layout"))
+	if err != nil {
+		return fmt.Errorf("failed to read OCI layout marker: %w", err)
+	}
+	if err := writeTarFile(tw, "oci-layout", layoutFile); err != nil {
+		return err
+	}
+
+	// Blobs of every image, each written once
+	written := make(map[v1.Hash]BundleBlob)
+	for i := range index.Images {
+		image := &index.Images[i]
+
+		descs, err := store.Blobs(image.Destination)
+		if err != nil {
+			return fmt.Errorf("failed to list blobs of %s: %w", image.Destination, err)
+		}
+
+		image.Blobs = make([]BundleBlob, 0, len(descs))
+		for _, desc := range descs {
+			blob, ok := written[desc.Digest]
+			switch {
+			case ok:
+				// Already written for a previous image
+			case shipped[desc.Digest.String()]:
+				blob = BundleBlob{Digest: desc.Digest.String(), Size: desc.Size, SHA256: desc.Digest.Hex}
+				index.Base.SkippedBlobs++
+			default:
+				if blob, err = writeTarBlob(tw, store, desc); err != nil {
+					return err
+				}
+			}
+			written[desc.Digest] = blob
+			image.Blobs = append(image.Blobs, blob)
+		}
+	}
+
+	// Layout index
+	layoutIndex, err := os.ReadFile(filepath.Join(store.Path(), "index.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read OCI layout index: %w", err)
+	}
+	if err := writeTarFile(tw, "index.json", layoutIndex); err != nil {
+		return err
+	}
+
+	// Configuration used for the export
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration: %w", err)
+	}
+	if err := writeTarFile(tw, bundleConfigFile, config); err != nil {
+		return err
+	}
+
+	// Bundle index last, once every checksum is known
+	rawIndex, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle index: %w", err)
+	}
+	if err := writeTarFile(tw, bundleIndexFile, rawIndex); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finalize bundle: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to finalize bundle: %w", err)
+	}
+
+	// The external index also lists the volumes of split bundles
+	if volumes != nil {
+		index.Volumes = volumes.Volumes()
+	}
+
+	return WriteBundleIndex(bundlePath+bundleIndexSuffix, index)
+}
+
+// WriteBundleIndex writes a bundle index to a JSON file
+func WriteBundleIndex(indexPath string, index *BundleIndex) error {
+	rawIndex, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle index: %w", err)
+	}
+
+	if err := os.WriteFile(indexPath, rawIndex, 0o644); err != nil {
+		return fmt.Errorf("failed to write bundle index: %w", err)
+	}
+
+	return nil
+}
+
+// ReadBundleIndex reads a bundle index from a JSON file
+func ReadBundleIndex(indexPath string) (*BundleIndex, error) {
+	rawIndex, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+
+	index := &BundleIndex{}
+	if err := json.Unmarshal(rawIndex, index); err != nil {
+		return nil, fmt.Errorf("failed to decode bundle index %s: %w", indexPath, err)
+	}
+
+	return index, nil
+}
+
+// openBundle opens a single-file bundle, or reassembles the volumes of a
+// split bundle from its external index
+func openBundle(bundlePath string) (io.ReadCloser, error) {
+	if _, err := os.Stat(bundlePath); err == nil {
+		file, err := os.Open(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bundle: %w", err)
+		}
+		return file, nil
+	}
+
+	index, err := ReadBundleIndex(bundlePath + bundleIndexSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("bundle %s not found and no volume index available: %w", bundlePath, err)
+	}
+
+	return newVolumeReader(filepath.Dir(bundlePath), index.Volumes)
+}
+
+// ExtractBundle loads the content of a bundle into the store and verifies
+// that every blob listed in the bundle index is present and intact
+func ExtractBundle(bundlePath string, store *Store) (*BundleIndex, error) {
+	in, err := openBundle(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	index, err := extractBundle(in, bundlePath, store)
+	if err != nil {
+		// Point at the volume being read when the error does not already
+		var volumeErr *VolumeError
+		if volumes, ok := in.(*volumeReader); ok && !errors.As(err, &volumeErr) {
+			return nil, fmt.Errorf("volume %s: %w", volumes.Current(), err)
+		}
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// extractBundle reads the archive stream into the store
+func extractBundle(in io.Reader, bundlePath string, store *Store) (*BundleIndex, error) {
+	var layoutIndex, config []byte
+	var index *BundleIndex
+	checksums := make(map[v1.Hash]string)
+
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		switch {
+		case strings.HasPrefix(header.Name, "blobs/"):
+			digest, err := v1.NewHash(strings.Replace(strings.TrimPrefix(header.Name, "blobs/"), "/", ":", 1))
+			if err != nil {
+				return nil, fmt.Errorf("invalid blob entry %s: %w", header.Name, err)
+			}
+			// Hash the bundle copy, even of a blob the store already holds
+			hasher := sha256.New()
+			if err := store.WriteBlob(digest, io.TeeReader(tr, hasher)); err != nil {
+				return nil, fmt.Errorf("failed to extract blob %s: %w", digest, err)
+			}
+			if _, err := io.Copy(hasher, tr); err != nil {
+				return nil, fmt.Errorf("failed to extract blob %s: %w", digest, err)
+			}
+			checksums[digest] = hex.EncodeToString(hasher.Sum(nil))
+		case header.Name == "index.json":
+			if layoutIndex, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("failed to read OCI layout index: %w", err)
+			}
+		case header.Name == bundleConfigFile:
+			if config, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("failed to read bundle configuration: %w", err)
+			}
+		case header.Name == bundleIndexFile:
+			index = &BundleIndex{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, fmt.Errorf("failed to decode bundle index: %w", err)
+			}
+		}
+	}
+
+	// Consume the end of the stream so the last volume is verified
+	if _, err := io.Copy(io.Discard, in); err != nil {
+		return nil, err
+	}
+
+	if index == nil {
+		return nil, fmt.Errorf("bundle index %s not found in %s", bundleIndexFile, bundlePath)
+	}
+	if layoutIndex == nil {
+		return nil, fmt.Errorf("OCI layout index not found in %s", bundlePath)
+	}
+	index.config = config
+
+	// Every blob of every image must now be in the store, and those shipped in
+	// the bundle must match the checksum of the index
+	for _, image := range index.Images {
+		for _, blob := range image.Blobs {
+			digest, err := v1.NewHash(blob.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blob digest %s: %w", blob.Digest, err)
+			}
+			if checksum, ok := checksums[digest]; ok && checksum != blob.SHA256 {
+				return nil, fmt.Errorf("checksum mismatch for blob %s of %s", blob.Digest, image.Destination)
+			}
+			if !store.HasBlob(digest) {
+				if index.Base != nil {
+					return nil, fmt.Errorf("blob %s of %s is missing: apply base bundle %s (%s) to the store first",
+						blob.Digest, image.Destination, index.Base.ID, index.Base.CreatedAt.Format(time.RFC3339))
+				}
+				return nil, fmt.Errorf("blob %s of %s is missing", blob.Digest, image.Destination)
+			}
+		}
+	}
+
+	// Register the bundle images in the store index
+	manifest, err := v1.ParseIndexManifest(bytes.NewReader(layoutIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OCI layout index: %w", err)
+	}
+	for _, desc := range manifest.Manifests {
+		if err := store.PutDescriptor(desc); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", desc.Digest, err)
+		}
+	}
+
+	return index, nil
+}
+
+// ImportConfig builds the configuration of an import from an extracted
+// bundle alone, from the BRMS file and the index it carries. Each block of
+// the BRMS file pushes the images exported from it, under their name in the
+// store, to its destination registry. Exclusions were applied at export.
+func (b *BundleIndex) ImportConfig() (*Config, error) {
+	if b.config == nil {
+		return nil, fmt.Errorf("bundle carries no %s", bundleConfigFile)
+	}
+
+	// The BRMS parser reads from a file
+	dir, err := os.MkdirTemp("", "magina-bundle-config-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, bundleConfigFile)
+	if err := os.WriteFile(configPath, b.config, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write bundle configuration: %w", err)
+	}
+
+	exported, err := ParseConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{Blocks: make([]*Block, 0, len(exported.Blocks))}
+	assigned := make([]bool, len(b.Images))
+
+	for i, block := range exported.Blocks {
+		imported := &Block{
+			DestinationRegistry: block.DestinationRegistry,
+			ImageMappings:       make([]ImageMapping, 0),
+		}
+
+		for j, image := range b.Images {
+			for _, mapping := range block.ImageMappings {
+				if image.Destination == mapping.Destination && image.Source == block.SourceRegistry.Qualify(mapping.Source) {
+					imported.ImageMappings = append(imported.ImageMappings, ImageMapping{
+						Source:      image.Destination,
+						Destination: image.Destination,
+					})
+					assigned[j] = true
+					break
+				}
+			}
+		}
+
+		if len(imported.ImageMappings) == 0 {
+			continue
+		}
+		if imported.DestinationRegistry.Host == "" {
+			return nil, fmt.Errorf("block %d of the bundle configuration has no destination registry", i+1)
+		}
+		config.Blocks = append(config.Blocks, imported)
+	}
+
+	for i, image := range b.Images {
+		if !assigned[i] {
+			return nil, fmt.Errorf("image %s of the bundle matches no block of its configuration", image.Source)
+		}
+	}
+
+	return config, nil
+}
+
+// writeTarFile writes an in-memory file to the archive
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// writeTarBlob copies a store blob to the archive and computes its checksum
+func writeTarBlob(tw *tar.Writer, store *Store, desc v1.Descriptor) (BundleBlob, error) {
+	blob := BundleBlob{
+		Digest: desc.Digest.String(),
+		Size:   desc.Size,
+	}
+
+	rc, err := store.Blob(desc.Digest)
+	if err != nil {
+		return blob, fmt.Errorf("failed to open blob %s: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+
+	name := path.Join("blobs", desc.Digest.Algorithm, desc.Digest.Hex)
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    desc.Size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return blob, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(rc, hasher)); err != nil {
+		return blob, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	blob.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	return blob, nil
+}
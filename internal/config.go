@@ -1,11 +1,14 @@
 package internal
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 
 	brmsparser "github.com/Caezarr-OSS/brms-parser/brms"
+	"github.com/google/go-containerregistry/pkg/name"
 )
 
 // Config represents the complete configuration for image migration
@@ -23,7 +26,66 @@ type Block struct {
 
 // Registry represents an image registry
 type Registry struct {
-	Host string // The registry hostname (e.g., "registry.example.com")
+	Scheme string // "http" or "https", empty when the BRMS header gives no protocol
+	Host   string // The registry hostname (e.g., "registry.example.com")
+}
+
+// Insecure reports whether the registry is reached over plain HTTP
+func (r Registry) Insecure() bool {
+	return r.Scheme == "http"
+}
+
+// URL returns the registry as written in the BRMS header
+func (r Registry) URL() string {
+	if r.Scheme == "" {
+		return r.Host
+	}
+	return r.Scheme + "://" + r.Host
+}
+
+// ParseReference qualifies an image with the registry host and parses it.
+// References to a plain-HTTP registry are marked insecure so that they are
+// not reached over TLS; the host is compared without its repository prefix.
+func (r Registry) ParseReference(image string) (name.Reference, error) {
+	image = r.Qualify(image)
+
+	ref, err := name.ParseReference(image)
+	if err != nil || !r.Insecure() || ref.Context().RegistryStr() != registryHost(r.Host) {
+		return ref, err
+	}
+
+	return name.ParseReference(image, name.Insecure)
+}
+
+// ParseRepository qualifies a repository name with the registry host and
+// parses it, as ParseReference does for an image. The name must carry no tag
+// or digest.
+func (r Registry) ParseRepository(repository string) (name.Repository, error) {
+	repository = r.Qualify(repository)
+
+	repo, err := name.NewRepository(repository)
+	if err != nil || !r.Insecure() || repo.RegistryStr() != registryHost(r.Host) {
+		return repo, err
+	}
+
+	return name.NewRepository(repository, name.Insecure)
+}
+
+// Qualify prefixes an image reference with the registry host unless the
+// reference already names a registry. A first path component is taken as a
+// registry when it contains a "." or a ":" or is "localhost", as Docker does.
+func (r Registry) Qualify(image string) string {
+	if r.Host == "" {
+		return image
+	}
+
+	if first, _, found := strings.Cut(image, "/"); found {
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			return image
+		}
+	}
+
+	return r.Host + "/" + image
 }
 
 // ImageMapping represents the mapping between a source and destination image
@@ -32,6 +94,22 @@ type ImageMapping struct {
 	Destination string
 }
 
+// isExcluded checks if an image is excluded from its block, by the name it is
+// read under or by the name it is pushed under. Exclusions are written either
+// as "!name" or as "name|".
+func isExcluded(mapping ImageMapping, exclusions []string) bool {
+	for _, exclusion := range exclusions {
+		pattern := strings.TrimPrefix(exclusion, "!")
+		if pattern == "" {
+			continue
+		}
+		if strings.Contains(mapping.Source, pattern) || strings.Contains(mapping.Destination, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseConfig parses a BRMS file and returns the configuration
 func ParseConfig(configPath string) (*Config, error) {
 	// Convert to absolute path
@@ -49,51 +127,163 @@ func ParseConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse BRMS file: %w", err)
 	}
 
+	// Locate the blocks in file order, the parsed block map being unordered
+	// and the parsed entities not being attached to their block
+	layout, err := scanBlockSections(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are listed by the parser in file order: the n-th mapping (or
+	// exclusion) of the file belongs to the block holding the n-th mapping
+	// (or exclusion) line
+	if len(parsed.Entities) != len(layout.mappings) {
+		return nil, fmt.Errorf("parsed %d image mappings from %d mapping lines: some mappings match no block", len(parsed.Entities), len(layout.mappings))
+	}
+	if len(parsed.IgnoredItems) != len(layout.exclusions) {
+		return nil, fmt.Errorf("parsed %d exclusions from %d exclusion lines: some exclusions match no block", len(parsed.IgnoredItems), len(layout.exclusions))
+	}
+
 	// Convert to configuration
 	config := &Config{
-		Blocks: make([]*Block, 0),
+		Blocks: make([]*Block, 0, len(layout.sections)),
 	}
+	blocks := make(map[*blockSection]*Block, len(layout.sections))
 
 	// Process each block
-	for sourceReg, destReg := range parsed.Blocks {
+	for _, section := range layout.sections {
 		// Parse source and destination registries
-		sourceRegistry, err := parseRegistryURL(sourceReg)
+		sourceRegistry, err := parseBlockRegistry(section.source)
 		if err != nil {
-			return nil, fmt.Errorf("invalid source registry: %w", err)
+			return nil, fmt.Errorf("line %d: invalid source registry: %w", section.line, err)
 		}
 
-		destRegistry, err := parseRegistryURL(destReg)
+		destRegistry, err := parseBlockRegistry(section.destination)
 		if err != nil {
-			return nil, fmt.Errorf("invalid destination registry: %w", err)
-		}
-
-		// Create image mappings
-		mappings := make([]ImageMapping, 0)
-		for _, mapping := range parsed.Entities {
-			mappings = append(mappings, ImageMapping{
-				Source:      mapping.Source,
-				Destination: mapping.Destination,
-			})
-		}
-
-		// Create exclusions
-		exclusions := make([]string, 0)
-		for _, exclusion := range parsed.IgnoredItems {
-			exclusions = append(exclusions, exclusion.Source)
+			return nil, fmt.Errorf("line %d: invalid destination registry: %w", section.line, err)
 		}
 
 		// Add block to configuration
-		config.Blocks = append(config.Blocks, &Block{
+		block := &Block{
 			SourceRegistry:      sourceRegistry,
 			DestinationRegistry: destRegistry,
-			ImageMappings:       mappings,
-			Exclusions:          exclusions,
+			ImageMappings:       make([]ImageMapping, 0),
+			Exclusions:          make([]string, 0),
+		}
+		blocks[section] = block
+		config.Blocks = append(config.Blocks, block)
+	}
+
+	// Create image mappings from the entities, each in the block it is listed in
+	for i, mapping := range parsed.Entities {
+		block := blocks[layout.mappings[i]]
+		block.ImageMappings = append(block.ImageMappings, ImageMapping{
+			Source:      strings.TrimSpace(mapping.Source),
+			Destination: strings.TrimSpace(mapping.Destination),
 		})
 	}
 
+	// Create exclusions from the ignored items, each in the block it is listed
+	// in; a header without destination is also reported as ignored by the
+	// parser, but only marks an export-only block
+	for i, exclusion := range parsed.IgnoredItems {
+		if layout.exclusions[i] == nil {
+			continue
+		}
+		block := blocks[layout.exclusions[i]]
+		block.Exclusions = append(block.Exclusions, strings.TrimSpace(exclusion.Source))
+	}
+
 	return config, nil
 }
 
+// blockSection is a block header of a BRMS file as written
+type blockSection struct {
+	line        int
+	source      string
+	destination string
+}
+
+// blockLayout is the block structure of a BRMS file: its blocks and the
+// block of each mapping and exclusion, in file order. An exclusion has no
+// block when it is a header without destination.
+type blockLayout struct {
+	sections   []*blockSection
+	mappings   []*blockSection
+	exclusions []*blockSection
+}
+
+// scanBlockSections splits a BRMS file into its blocks, in file order,
+// classifying each line the way the BRMS parser does
+func scanBlockSections(configPath string) (*blockLayout, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BRMS file: %w", err)
+	}
+	defer file.Close()
+
+	layout := &blockLayout{}
+	var current *blockSection
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Block header, ignored by the parser when it has no destination
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			source, destination, _ := strings.Cut(strings.Trim(line, "[]"), "|")
+			current = &blockSection{
+				line:        lineNumber,
+				source:      strings.TrimSpace(source),
+				destination: strings.TrimSpace(destination),
+			}
+			layout.sections = append(layout.sections, current)
+			if destination == "" {
+				layout.exclusions = append(layout.exclusions, nil)
+			}
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("line %d: entry outside of a block", lineNumber)
+		}
+
+		// Entry, an exclusion when it has no destination
+		if index := strings.Index(line, "#"); index != -1 {
+			line = strings.TrimSpace(line[:index])
+		}
+		if _, destination, _ := strings.Cut(line, "|"); destination == "" {
+			layout.exclusions = append(layout.exclusions, current)
+		} else {
+			layout.mappings = append(layout.mappings, current)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read BRMS file: %w", err)
+	}
+
+	return layout, nil
+}
+
+// parseBlockRegistry parses one side of a block header, which may be left
+// empty for export-only or import-only blocks
+func parseBlockRegistry(url string) (Registry, error) {
+	if strings.TrimSpace(url) == "" {
+		return Registry{}, nil
+	}
+	return parseRegistryURL(url)
+}
+
+// ParseRegistry parses a registry given on the command line, with or
+// without its protocol
+func ParseRegistry(url string) (Registry, error) {
+	return parseRegistryURL(url)
+}
+
 // parseRegistryURL parses a registry URL and returns a Registry structure
 func parseRegistryURL(url string) (Registry, error) {
 	// Clean URL
@@ -102,14 +292,20 @@ func parseRegistryURL(url string) (Registry, error) {
 		return Registry{}, fmt.Errorf("registry URL cannot be empty")
 	}
 
-	// Remove protocol if present
-	url = strings.TrimPrefix(url, "http://")
-	url = strings.TrimPrefix(url, "https://")
+	// Keep the protocol if present
+	var scheme string
+	for _, prefix := range []string{"http", "https"} {
+		if strings.HasPrefix(url, prefix+"://") {
+			scheme = prefix
+			url = strings.TrimPrefix(url, prefix+"://")
+		}
+	}
 
 	// Remove leading and trailing slashes
 	url = strings.Trim(url, "/")
 
 	return Registry{
-		Host: url,
+		Scheme: scheme,
+		Host:   url,
 	}, nil
 }
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []*Block
+		wantErr bool
+	}{
+		{
+			name: "single block",
+			content: `[https://source.example.com|https://dest.example.com]
+nginx:1.25|mirror/nginx:1.25
+!nginx:1.25-debug
+`,
+			want: []*Block{{
+				SourceRegistry:      Registry{Scheme: "https", Host: "source.example.com"},
+				DestinationRegistry: Registry{Scheme: "https", Host: "dest.example.com"},
+				ImageMappings:       []ImageMapping{{Source: "nginx:1.25", Destination: "mirror/nginx:1.25"}},
+				Exclusions:          []string{"!nginx:1.25-debug"},
+			}},
+		},
+		{
+			name: "multiple blocks",
+			content: `# Two blocks, each with its own mappings and exclusions
+[source-a.example.com|dest-a.example.com]
+app:1|app:1
+!test/
+
+[source-b.example.com|dest-b.example.com]
+app:1|app:1
+tools:2|tools:2
+!dev/
+`,
+			want: []*Block{
+				{
+					SourceRegistry:      Registry{Host: "source-a.example.com"},
+					DestinationRegistry: Registry{Host: "dest-a.example.com"},
+					ImageMappings:       []ImageMapping{{Source: "app:1", Destination: "app:1"}},
+					Exclusions:          []string{"!test/"},
+				},
+				{
+					SourceRegistry:      Registry{Host: "source-b.example.com"},
+					DestinationRegistry: Registry{Host: "dest-b.example.com"},
+					ImageMappings: []ImageMapping{
+						{Source: "app:1", Destination: "app:1"},
+						{Source: "tools:2", Destination: "tools:2"},
+					},
+					Exclusions: []string{"!dev/"},
+				},
+			},
+		},
+		{
+			name: "export-only block",
+			content: `[https://registry.company.com|]
+app:1|app:1
+`,
+			want: []*Block{{
+				SourceRegistry: Registry{Scheme: "https", Host: "registry.company.com"},
+				ImageMappings:  []ImageMapping{{Source: "app:1", Destination: "app:1"}},
+				Exclusions:     []string{},
+			}},
+		},
+		{
+			name: "header without separator",
+			content: `[registry.company.com]
+app:1|app:1
+[source.example.com|dest.example.com]
+lib:1|lib:1
+`,
+			want: []*Block{
+				{
+					SourceRegistry: Registry{Host: "registry.company.com"},
+					ImageMappings:  []ImageMapping{{Source: "app:1", Destination: "app:1"}},
+					Exclusions:     []string{},
+				},
+				{
+					SourceRegistry:      Registry{Host: "source.example.com"},
+					DestinationRegistry: Registry{Host: "dest.example.com"},
+					ImageMappings:       []ImageMapping{{Source: "lib:1", Destination: "lib:1"}},
+					Exclusions:          []string{},
+				},
+			},
+		},
+		{
+			name: "exclusions without destination",
+			content: `[source.example.com|dest.example.com]
+app:1|app:1
+legacy:1|
+debug
+`,
+			want: []*Block{{
+				SourceRegistry:      Registry{Host: "source.example.com"},
+				DestinationRegistry: Registry{Host: "dest.example.com"},
+				ImageMappings:       []ImageMapping{{Source: "app:1", Destination: "app:1"}},
+				Exclusions:          []string{"legacy:1", "debug"},
+			}},
+		},
+		{
+			name: "spaces and inline comments",
+			content: `[source.example.com | dest.example.com]
+app:1 | app:1 # main image
+legacy:1 | # dropped
+`,
+			want: []*Block{{
+				SourceRegistry:      Registry{Host: "source.example.com"},
+				DestinationRegistry: Registry{Host: "dest.example.com"},
+				ImageMappings:       []ImageMapping{{Source: "app:1", Destination: "app:1"}},
+				Exclusions:          []string{"legacy:1"},
+			}},
+		},
+		{
+			name:    "entry outside of a block",
+			content: "app:1|app:1\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.brms")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := ParseConfig(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(config.Blocks, tt.want) {
+				t.Errorf("blocks:\n got  %+v\n want %+v", derefBlocks(config.Blocks), derefBlocks(tt.want))
+			}
+		})
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	tests := []struct {
+		name       string
+		mapping    ImageMapping
+		exclusions []string
+		want       bool
+	}{
+		{"no exclusions", ImageMapping{"app:1", "app:1"}, nil, false},
+		{"excluded by source", ImageMapping{"test/app:1", "app:1"}, []string{"!test/"}, true},
+		{"excluded by destination", ImageMapping{"app:1", "dev/app:1"}, []string{"!dev/"}, true},
+		{"excluded without bang", ImageMapping{"legacy:1", "legacy:1"}, []string{"legacy:1"}, true},
+		{"not matching", ImageMapping{"app:1", "app:1"}, []string{"!test/"}, false},
+		{"empty exclusion", ImageMapping{"app:1", "app:1"}, []string{"!"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isExcluded(tt.mapping, tt.exclusions); got != tt.want {
+				t.Errorf("isExcluded(%v, %v) = %v, want %v", tt.mapping, tt.exclusions, got, tt.want)
+			}
+		})
+	}
+}
+
+// derefBlocks returns the blocks by value, for readable failure messages
+func derefBlocks(blocks []*Block) []Block {
+	values := make([]Block, 0, len(blocks))
+	for _, block := range blocks {
+		values = append(values, *block)
+	}
+	return values
+}
@@ -4,16 +4,18 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strings"
 
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 // ConvertOptions contient les options pour l'opération de conversion
 type ConvertOptions struct {
-	CleanOnError bool
 	VerboseLevel int
+	StorePath    string        // Répertoire du stockage OCI local (stockage par défaut si vide)
+	Platforms    []v1.Platform // Plateformes conservées des index multi-plateformes (toutes si vide)
+	Jobs         int           // Images converties en parallèle (1 si zéro)
+	Rollback     *Rollback     // Enregistre les entrées écrites, pour les annuler si l'exécution échoue (nil pour les garder)
 }
 
 // ConvertResult représente le résultat d'une conversion d'image
@@ -53,17 +55,32 @@ func (h *ConvertHandler) ConvertImages(block *Block) <-chan ConvertResult {
 			return
 		}
 
-		// Traiter chaque mapping d'image
+		// Ouvrir le stockage local
+		store, err := OpenStore(h.options.StorePath)
+		if err != nil {
+			results <- ConvertResult{Error: fmt.Errorf("échec de l'ouverture du stockage local : %w", err)}
+			return
+		}
+
+		// Retenir les mappings d'image qui ne sont pas exclus
+		mappings := make([]ImageMapping, 0, len(block.ImageMappings))
 		for _, mapping := range block.ImageMappings {
-			// Vérifier si l'image est exclue
-			if h.isExcluded(mapping.Source, block.Exclusions) {
-				continue
+			if !isExcluded(mapping, block.Exclusions) {
+				mappings = append(mappings, mapping)
 			}
-
-			// Convertir l'image
-			result := h.convertSingleImage(mapping.Source, mapping.Source, mapping.Destination)
-			results <- result
 		}
+
+		// Convertir les images en parallèle selon le nombre de tâches ; les
+		// résultats gardent l'ordre des mappings
+		runOrdered(h.ctx, h.options.Jobs, mappings,
+			func(mapping ImageMapping) ConvertResult {
+				return h.convertSingleImage(mapping.Source, mapping.Source, mapping.Destination, store)
+			},
+			func(mapping ImageMapping, err error) ConvertResult {
+				return ConvertResult{SourceImage: mapping.Source, LocalImage: mapping.Source, DestinationImage: mapping.Destination, Error: err}
+			},
+			func(result ConvertResult) { results <- result },
+		)
 	}()
 
 	return results
@@ -86,63 +103,73 @@ func (h *ConvertHandler) validateConvertBlock(block *Block) error {
 	return nil
 }
 
-// isExcluded vérifie si une image est dans la liste des exclusions
-func (h *ConvertHandler) isExcluded(image string, exclusions []string) bool {
-	for _, exclusion := range exclusions {
-		if strings.HasPrefix(exclusion, "!") {
-			pattern := exclusion[1:]
-			if strings.Contains(image, pattern) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 // convertSingleImage convertit une seule image
-func (h *ConvertHandler) convertSingleImage(sourceImage, localImage, destinationImage string) ConvertResult {
+func (h *ConvertHandler) convertSingleImage(sourceImage, localImage, destinationImage string, store *Store) ConvertResult {
 	result := ConvertResult{
 		SourceImage:      sourceImage,
 		LocalImage:       localImage,
 		DestinationImage: destinationImage,
 	}
 
-	// Créer une référence pour l'image locale
-	localRef, err := name.ParseReference(localImage)
-	if err != nil {
-		result.Error = fmt.Errorf("échec de l'analyse de la référence de l'image locale : %w", err)
+	// Valider la référence de l'image de destination
+	if _, err := name.ParseReference(destinationImage); err != nil {
+		result.Error = fmt.Errorf("échec de l'analyse de la référence de l'image de destination : %w", err)
 		return result
 	}
 
-	// Créer une référence pour l'image de destination
-	destRef, err := name.ParseReference(destinationImage)
-	if err != nil {
-		result.Error = fmt.Errorf("échec de l'analyse de la référence de l'image de destination : %w", err)
+	// Retaguer l'image dans le stockage local
+	if err := h.tagImage(localImage, destinationImage, store); err != nil {
+		result.Error = err
 		return result
 	}
 
-	// Options pour la conversion
-	opts := []remote.Option{
-		remote.WithContext(h.ctx),
+	// Journaliser la réussite si verbose
+	if h.options.VerboseLevel > 0 {
+		h.logger.Printf("Conversion d'image réussie : %s -> %s", localImage, destinationImage)
 	}
 
-	// Charger l'image depuis le stockage local
-	img, err := remote.Image(localRef, opts...)
+	return result
+}
+
+// tagImage ajoute le nom de destination à une entrée du stockage local.
+// Un index multi-plateformes est conservé tel quel (même digest), sauf si un
+// filtre de plateformes est demandé : l'index filtré est alors écrit sous le
+// nom de destination.
+func (h *ConvertHandler) tagImage(localImage, destinationImage string, store *Store) error {
+	desc, err := store.Descriptor(localImage)
 	if err != nil {
-		result.Error = fmt.Errorf("échec du chargement de l'image locale : %w", err)
-		return result
+		return fmt.Errorf("échec du chargement de l'image locale : %w", err)
 	}
 
-	// Enregistrer l'image avec la nouvelle référence
-	if err := remote.Write(destRef, img, opts...); err != nil {
-		result.Error = fmt.Errorf("échec de l'écriture de l'image : %w", err)
-		return result
+	// Retenir ce que le stockage contenait sous ce nom, pour le rétablir en cas d'échec
+	if err := h.options.Rollback.trackStore(store, destinationImage); err != nil {
+		return err
 	}
 
-	// Journaliser la réussite si verbose
-	if h.options.VerboseLevel > 0 {
-		h.logger.Printf("Conversion d'image réussie : %s -> %s", localImage, destinationImage)
+	if !desc.MediaType.IsIndex() || len(h.options.Platforms) == 0 {
+		if err := store.Tag(localImage, destinationImage); err != nil {
+			return fmt.Errorf("échec du retag de l'image locale : %w", err)
+		}
+		return nil
 	}
 
-	return result
+	idx, err := store.ImageIndex(localImage)
+	if err != nil {
+		return fmt.Errorf("échec du chargement de l'index local : %w", err)
+	}
+
+	if idx, err = filterPlatforms(idx, h.options.Platforms); err != nil {
+		return err
+	}
+
+	if err := store.WriteIndex(destinationImage, idx); err != nil {
+		return fmt.Errorf("échec de l'écriture de l'index filtré : %w", err)
+	}
+
+	// Les artefacts attachés suivent l'index filtré
+	if err := store.CopyReferrers(localImage, destinationImage); err != nil {
+		return fmt.Errorf("échec de la copie des artefacts attachés : %w", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,496 @@
+package internal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+)
+
+const (
+	// credentialStoreVersion is the version of the credential store file format
+	credentialStoreVersion = 1
+
+	// pbkdf2Iterations is the PBKDF2-SHA256 work factor applied to the
+	// passphrase of new stores; existing stores keep the one they record
+	pbkdf2Iterations = 600000
+
+	// Key derivations recorded in the store file
+	kdfPassphrase = "pbkdf2-sha256"  // PBKDF2-SHA256 of the passphrase
+	kdfKeyFile    = "keyfile-sha256" // SHA-256 of the salt and the key file
+
+	// PassphraseEnv names the environment variable holding the passphrase of
+	// the credential store, for non-interactive use
+	PassphraseEnv = "MAGINA_PASSPHRASE"
+)
+
+// CredentialStore is a file of registry credentials encrypted with
+// AES-256-GCM. The key is derived from a passphrase or read from a key file.
+// The file is only decrypted when an entry is first needed.
+type CredentialStore struct {
+	path       string
+	keyFile    string
+	key        []byte
+	kdf        string
+	iterations int
+	salt       []byte
+	entries    map[string]storedCredential
+	loaded     bool
+}
+
+// StoredEntry describes an entry of the credential store without its secret
+type StoredEntry struct {
+	Registry  string // Host, optionally followed by a repository prefix
+	Role      Role   // Empty when the entry serves both roles
+	Username  string
+	TokenType TokenType // Empty for username and password credentials
+}
+
+// storedCredential is the encrypted form of a credential
+type storedCredential struct {
+	Registry      string `json:"registry,omitempty"`
+	Role          Role   `json:"role,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identityToken,omitempty"`
+	RegistryToken string `json:"registryToken,omitempty"`
+}
+
+// credentials returns the stored credential as Credentials
+func (s storedCredential) credentials() *Credentials {
+	if s.Password != "" {
+		return NewCredentials(s.Username, s.Password)
+	}
+
+	return &Credentials{
+		Username:      s.Username,
+		IdentityToken: s.IdentityToken,
+		RegistryToken: s.RegistryToken,
+	}
+}
+
+// credentialStoreFile is the on-disk envelope of the credential store
+type credentialStoreFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// DefaultCredentialStorePath returns the default location of the credential
+// store under the user config directory
+func DefaultCredentialStorePath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user config directory: %w", err)
+	}
+
+	return filepath.Join(configDir, "magina", "credentials.enc"), nil
+}
+
+// NewCredentialStore creates a credential store backed by the given file.
+// An empty path selects the default location. Without a key file, the store
+// is unlocked with a passphrase from $MAGINA_PASSPHRASE or the terminal.
+func NewCredentialStore(storePath, keyFile string) (*CredentialStore, error) {
+	if storePath == "" {
+		defaultPath, err := DefaultCredentialStorePath()
+		if err != nil {
+			return nil, err
+		}
+		storePath = defaultPath
+	}
+
+	return &CredentialStore{
+		path:    storePath,
+		keyFile: keyFile,
+		entries: make(map[string]storedCredential),
+	}, nil
+}
+
+// Path returns the file of the credential store
+func (c *CredentialStore) Path() string {
+	return c.path
+}
+
+// Exists reports whether the credential store file exists
+func (c *CredentialStore) Exists() bool {
+	_, err := os.Stat(c.path)
+	return err == nil
+}
+
+// storeKey returns the key of the entry of a registry and role
+func storeKey(registry string, role Role) string {
+	if role == "" {
+		return registry
+	}
+	return registry + "#" + string(role)
+}
+
+// Get returns the credentials stored for exactly this registry and role, or
+// nil if there are none
+func (c *CredentialStore) Get(registry string, role Role) (*Credentials, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	entry, ok := c.entries[storeKey(registry, role)]
+	if !ok {
+		return nil, nil
+	}
+
+	return entry.credentials(), nil
+}
+
+// Lookup returns the best stored credentials for a role on a registry, from
+// the most specific repository prefix down to the bare host. At each level an
+// entry saved for the role wins over one saved for both roles.
+func (c *CredentialStore) Lookup(role Role, registryURL string) (*Credentials, error) {
+	for _, scope := range credentialScopes(registryURL) {
+		for _, candidate := range []Role{role, ""} {
+			creds, err := c.Get(scope, candidate)
+			if err != nil || creds != nil {
+				return creds, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Put stores the credentials of a registry and role and saves the store
+func (c *CredentialStore) Put(registry string, role Role, creds *Credentials) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	c.entries[storeKey(registry, role)] = storedCredential{
+		Registry:      registry,
+		Role:          role,
+		Username:      creds.Username,
+		Password:      creds.Password,
+		IdentityToken: creds.IdentityToken,
+		RegistryToken: creds.RegistryToken,
+	}
+
+	return c.save()
+}
+
+// Delete removes the credentials of a registry and role and saves the store.
+// It reports whether an entry was removed.
+func (c *CredentialStore) Delete(registry string, role Role) (bool, error) {
+	if err := c.load(); err != nil {
+		return false, err
+	}
+
+	key := storeKey(registry, role)
+	if _, ok := c.entries[key]; !ok {
+		return false, nil
+	}
+	delete(c.entries, key)
+
+	return true, c.save()
+}
+
+// Clear removes the credential store file. It does not need the passphrase.
+func (c *CredentialStore) Clear() error {
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove credential store: %w", err)
+	}
+
+	c.entries = make(map[string]storedCredential)
+	c.key = nil
+	c.loaded = false
+	return nil
+}
+
+// List returns the stored entries sorted by registry and role
+func (c *CredentialStore) List() ([]StoredEntry, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]StoredEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, StoredEntry{
+			Registry:  entry.Registry,
+			Role:      entry.Role,
+			Username:  entry.Username,
+			TokenType: entry.credentials().TokenType(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Registry != entries[j].Registry {
+			return entries[i].Registry < entries[j].Registry
+		}
+		return entries[i].Role < entries[j].Role
+	})
+
+	return entries, nil
+}
+
+// load decrypts the store file on first use. A missing file is an empty store.
+func (c *CredentialStore) load() error {
+	if c.loaded {
+		return nil
+	}
+
+	raw, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		c.salt = make([]byte, 16)
+		if _, err := rand.Read(c.salt); err != nil {
+			return fmt.Errorf("failed to generate salt: %w", err)
+		}
+		c.kdf, c.iterations = kdfPassphrase, pbkdf2Iterations
+		if c.keyFile != "" {
+			c.kdf, c.iterations = kdfKeyFile, 0
+		}
+		c.loaded = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read credential store: %w", err)
+	}
+
+	file := &credentialStoreFile{}
+	if err := json.Unmarshal(raw, file); err != nil {
+		return fmt.Errorf("failed to decode credential store %s: %w", c.path, err)
+	}
+	if file.Version != credentialStoreVersion {
+		return fmt.Errorf("unsupported credential store version %d", file.Version)
+	}
+
+	// The key is derived as recorded when the store was created
+	switch file.KDF {
+	case kdfPassphrase:
+		if c.keyFile != "" {
+			return fmt.Errorf("credential store %s is encrypted with a passphrase, not a key file: drop --key-file", c.path)
+		}
+		if file.Iterations < 1 {
+			return fmt.Errorf("invalid credential store %s: missing PBKDF2 iteration count", c.path)
+		}
+	case kdfKeyFile:
+		if c.keyFile == "" {
+			return fmt.Errorf("credential store %s is encrypted with a key file: use --key-file", c.path)
+		}
+	default:
+		return fmt.Errorf("unsupported credential store key derivation %q", file.KDF)
+	}
+
+	c.kdf, c.iterations, c.salt = file.KDF, file.Iterations, file.Salt
+	if err := c.deriveKey(false); err != nil {
+		return err
+	}
+
+	gcm, err := c.cipher()
+	if err != nil {
+		return err
+	}
+
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt credential store: wrong passphrase or key file")
+	}
+
+	if err := json.Unmarshal(plain, &c.entries); err != nil {
+		return fmt.Errorf("failed to decode credential store entries: %w", err)
+	}
+
+	// Entries saved before roles were supported are keyed by registry alone
+	for key, entry := range c.entries {
+		if entry.Registry == "" {
+			entry.Registry = key
+			c.entries[key] = entry
+		}
+	}
+
+	c.loaded = true
+	return nil
+}
+
+// save encrypts the entries with a fresh nonce and writes the store file
+func (c *CredentialStore) save() error {
+	if c.key == nil {
+		if err := c.deriveKey(true); err != nil {
+			return err
+		}
+	}
+
+	gcm, err := c.cipher()
+	if err != nil {
+		return err
+	}
+
+	plain, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode credential store entries: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	file := credentialStoreFile{
+		Version:    credentialStoreVersion,
+		KDF:        c.kdf,
+		Iterations: c.iterations,
+		Salt:       c.salt,
+		Nonce:      nonce,
+		Data:       gcm.Seal(nil, nonce, plain, nil),
+	}
+
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode credential store: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create credential store directory: %w", err)
+	}
+
+	// Write then rename so that an interrupted save keeps the previous store
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write credential store: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to write credential store: %w", err)
+	}
+
+	return nil
+}
+
+// deriveKey computes the encryption key from the key file or the passphrase,
+// as the store's key derivation requires. A new store asks for the passphrase
+// twice.
+func (c *CredentialStore) deriveKey(create bool) error {
+	if c.kdf == kdfKeyFile {
+		secret, err := os.ReadFile(c.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read key file: %w", err)
+		}
+		if len(secret) < 32 {
+			return fmt.Errorf("key file %s must hold at least 32 bytes", c.keyFile)
+		}
+		key := sha256.Sum256(append(append([]byte{}, c.salt...), secret...))
+		c.key = key[:]
+		return nil
+	}
+
+	passphrase, err := readPassphrase(create)
+	if err != nil {
+		return err
+	}
+
+	c.key = pbkdf2.Key([]byte(passphrase), c.salt, c.iterations, 32, sha256.New)
+	return nil
+}
+
+// cipher returns the AES-256-GCM cipher of the store key
+func (c *CredentialStore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// readPassphrase reads the credential store passphrase from the environment
+// or, without echo, from the terminal
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("credential store is locked: set %s or use a key file", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "Credential store passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("empty passphrase")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+
+	return string(passphrase), nil
+}
+
+// VerifyCredentials checks credentials against a registry by authenticating
+// to its /v2/ endpoint
+func VerifyCredentials(ctx context.Context, registry Registry, creds *Credentials, tlsOptions TLSOptions) error {
+	var opts []name.Option
+	if registry.Insecure() {
+		opts = append(opts, name.Insecure)
+	}
+
+	reg, err := name.NewRegistry(registryHost(registry.Host), opts...)
+	if err != nil {
+		return fmt.Errorf("invalid registry %s: %w", registry.Host, err)
+	}
+
+	base, err := tlsOptions.Transport(reg.RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	auth := authn.FromConfig(creds.AuthConfig())
+
+	// Token registries reject bad credentials while issuing the token
+	rt, err := transport.NewWithContext(ctx, reg, auth, base, []string{reg.Scope(transport.PullScope)})
+	if err != nil {
+		return fmt.Errorf("authentication failed for %s: %w", registry.Host, err)
+	}
+
+	// Basic auth registries reject them on the first request
+	url := fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", registry.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("authentication failed for %s: %s", registry.Host, strings.TrimSpace(resp.Status))
+	}
+
+	return nil
+}
@@ -4,40 +4,54 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 // ExportOptions contains the options for the export operation
 type ExportOptions struct {
-	CleanOnError bool
 	VerboseLevel int
-	Credentials  *Credentials
+	Auth         authn.Authenticator // Credentials of the source registry, resolved on each use (anonymous if nil)
+	StorePath    string              // Local OCI layout directory (default store if empty)
+	Platforms    []v1.Platform       // Platforms kept from multi-platform indexes (all if empty)
+	TLS          TLSOptions          // CA certificates and client certificates of the registries
+	Jobs         int                 // Images exported in parallel (1 if zero)
+	MaxConns     int                 // Connections per registry host (uncapped if zero)
+	Retry        RetryPolicy         // Attempts on transient registry and network errors
+	Journal      *Journal            // Images completed by a previous run, skipped when resuming (nil to disable)
+	Rollback     *Rollback           // Records the artifacts written, to undo them if the run fails (nil to keep them)
 }
 
 // ExportResult represents the result of an image export
 type ExportResult struct {
-	SourceImage  string
-	LocalImage   string
-	Error        error
+	SourceImage string
+	LocalImage  string
+	Digest      string
+	Referrers   int  // Signatures, SBOMs and attestations exported with the image
+	Retries     int  // Attempts made after the first one failed on a transient error
+	Resumed     bool // Already exported by a previous run, per the journal
+	Error       error
 }
 
 // ExportHandler handles image exports
 type ExportHandler struct {
-	ctx     context.Context
-	options ExportOptions
-	logger  *log.Logger
+	ctx        context.Context
+	options    ExportOptions
+	logger     *log.Logger
+	transports *hostTransports
 }
 
 // NewExportHandler creates a new export handler
 func NewExportHandler(ctx context.Context, options ExportOptions) *ExportHandler {
 	return &ExportHandler{
-		ctx:     ctx,
-		options: options,
-		logger:  log.New(log.Writer(), "[EXPORT] ", log.LstdFlags),
+		ctx:        ctx,
+		options:    options,
+		logger:     log.New(log.Writer(), "[EXPORT] ", log.LstdFlags),
+		transports: newHostTransports(options.TLS, options.MaxConns),
 	}
 }
 
@@ -54,20 +68,47 @@ func (h *ExportHandler) ExportImages(block *Block) <-chan ExportResult {
 			return
 		}
 
+		// Open the local store
+		store, err := OpenStore(h.options.StorePath)
+		if err != nil {
+			results <- ExportResult{Error: fmt.Errorf("failed to open local store: %w", err)}
+			return
+		}
+
 		// Configure authentication
 		auth := h.getAuthConfig(block.SourceRegistry.Host)
 
-		// Process each image mapping
+		// Collect the image mappings that are not excluded
+		mappings := make([]ImageMapping, 0, len(block.ImageMappings))
 		for _, mapping := range block.ImageMappings {
-			// Check if the image is excluded
-			if h.isExcluded(mapping.Source, block.Exclusions) {
-				continue
+			if !isExcluded(mapping, block.Exclusions) {
+				mappings = append(mappings, mapping)
 			}
-
-			// Export the image
-			result := h.exportSingleImage(mapping.Source, mapping.Destination, auth)
-			results <- result
 		}
+
+		// Export the images, resolved against the source registry, in parallel
+		// up to the configured number of jobs; results keep the mapping order
+		runOrdered(h.ctx, h.options.Jobs, mappings,
+			func(mapping ImageMapping) ExportResult {
+				result, retries := withRetry(h.ctx, h.options.Retry, registryHost(block.SourceRegistry.Host),
+					func(ctx context.Context) ExportResult {
+						return h.exportSingleImage(ctx, mapping.Source, mapping.Destination, block.SourceRegistry, auth, store)
+					},
+					func(result ExportResult) error { return result.Error },
+					func(retry int, delay time.Duration, err error) {
+						if h.options.VerboseLevel > 1 {
+							h.logger.Printf("retrying %s in %s (retry %d): %v", mapping.Source, delay.Round(time.Millisecond), retry, err)
+						}
+					},
+				)
+				result.Retries = retries
+				return result
+			},
+			func(mapping ImageMapping, err error) ExportResult {
+				return ExportResult{SourceImage: block.SourceRegistry.Qualify(mapping.Source), LocalImage: mapping.Destination, Error: err}
+			},
+			func(result ExportResult) { results <- result },
+		)
 	}()
 
 	return results
@@ -92,52 +133,55 @@ func (h *ExportHandler) validateExportBlock(block *Block) error {
 
 // getAuthConfig configures authentication for the registry
 func (h *ExportHandler) getAuthConfig(registryURL string) authn.Authenticator {
-	if h.options.Credentials == nil {
+	if h.options.Auth == nil {
 		return authn.Anonymous
 	}
 
-	return authn.FromConfig(authn.AuthConfig{
-		Username: h.options.Credentials.Username,
-		Password: h.options.Credentials.Password,
-		Auth:     h.options.Credentials.Auth,
-	})
-}
-
-// isExcluded checks if an image is in the exclusion list
-func (h *ExportHandler) isExcluded(image string, exclusions []string) bool {
-	for _, exclusion := range exclusions {
-		if strings.Contains(image, exclusion) {
-			return true
-		}
-	}
-	return false
+	return h.options.Auth
 }
 
 // exportSingleImage exports a single image
-func (h *ExportHandler) exportSingleImage(sourceImage, localImage string, auth authn.Authenticator) ExportResult {
+func (h *ExportHandler) exportSingleImage(ctx context.Context, sourceImage, localImage string, registry Registry, auth authn.Authenticator, store *Store) ExportResult {
 	result := ExportResult{
-		SourceImage: sourceImage,
+		SourceImage: registry.Qualify(sourceImage),
 		LocalImage:  localImage,
 	}
 
 	// Create a reference for the source image
-	sourceRef, err := name.ParseReference(sourceImage)
+	sourceRef, err := registry.ParseReference(sourceImage)
 	if err != nil {
 		result.Error = fmt.Errorf("failed to parse source image reference: %w", err)
 		return result
 	}
 
-	// Create a reference for the local image
-	localRef, err := name.ParseReference(localImage)
-	if err != nil {
+	// Validate the local image reference
+	if _, err := name.ParseReference(localImage); err != nil {
 		result.Error = fmt.Errorf("failed to parse local image reference: %w", err)
 		return result
 	}
 
+	// Skip an image a previous run exported, if the store still holds it
+	if digest, ok := h.options.Journal.Completed(PhaseExport, registry.URL(), sourceImage, localImage); ok {
+		if stored, err := store.Descriptor(localImage); err == nil && stored.Digest.String() == digest {
+			result.Digest = digest
+			result.Resumed = true
+			return result
+		}
+	}
+
+	// TLS material of the source registry
+	transport, err := h.transports.get(sourceRef.Context().RegistryStr())
+	if err != nil {
+		result.Error = fmt.Errorf("failed to configure TLS: %w", err)
+		return result
+	}
+
 	// Options for export
 	opts := []remote.Option{
 		remote.WithAuth(auth),
-		remote.WithContext(h.ctx),
+		remote.WithContext(ctx),
+		remote.WithTransport(transport),
+		remote.WithRetryStatusCodes(), // Retried per image, see withRetry
 	}
 
 	// Load the image from the source registry
@@ -147,22 +191,83 @@ func (h *ExportHandler) exportSingleImage(sourceImage, localImage string, auth a
 		return result
 	}
 
-	// Get the image from the descriptor
-	img, err := descriptor.Image()
+	// Remember what the store held under this name, to restore it on failure
+	if err := h.options.Rollback.trackStore(store, localImage); err != nil {
+		result.Error = err
+		return result
+	}
+
+	// Keep multi-platform indexes whole instead of resolving a single image
+	if descriptor.MediaType.IsIndex() {
+		idx, err := descriptor.ImageIndex()
+		if err != nil {
+			result.Error = fmt.Errorf("failed to get index from descriptor: %w", err)
+			return result
+		}
+
+		if idx, err = filterPlatforms(idx, h.options.Platforms); err != nil {
+			result.Error = err
+			return result
+		}
+
+		// Save the index and all its children in the local store
+		if err := store.WriteIndex(localImage, idx); err != nil {
+			result.Error = fmt.Errorf("failed to save index locally: %w", err)
+			return result
+		}
+	} else if isArtifact(descriptor) {
+		// Copy artifacts (Helm charts, WASM modules…) without interpreting their media types
+		artifact, err := newRemoteArtifact(sourceRef.Context(), descriptor, opts)
+		if err != nil {
+			result.Error = err
+			return result
+		}
+
+		if err := store.WriteArtifact(localImage, artifact); err != nil {
+			result.Error = fmt.Errorf("failed to save artifact locally: %w", err)
+			return result
+		}
+	} else {
+		// Get the image from the descriptor
+		img, err := descriptor.Image()
+		if err != nil {
+			result.Error = fmt.Errorf("failed to get image from descriptor: %w", err)
+			return result
+		}
+
+		// Save the image in the local store
+		if err := store.WriteImage(localImage, img); err != nil {
+			result.Error = fmt.Errorf("failed to save image locally: %w", err)
+			return result
+		}
+	}
+
+	// Record the stored digest, which differs from the source one when platforms were filtered out
+	stored, err := store.Descriptor(localImage)
 	if err != nil {
-		result.Error = fmt.Errorf("failed to get image from descriptor: %w", err)
+		result.Error = err
 		return result
 	}
+	result.Digest = stored.Digest.String()
 
-	// Save the image locally
-	if err := remote.Write(localRef, img, opts...); err != nil {
-		result.Error = fmt.Errorf("failed to save image locally: %w", err)
+	// Bring the artifacts attached to the source manifest along
+	var referrersLogger *log.Logger
+	if h.options.VerboseLevel > 0 {
+		referrersLogger = h.logger
+	}
+	if result.Referrers, err = exportReferrers(sourceRef.Context(), descriptor.Digest, localImage, store, opts, referrersLogger); err != nil {
+		result.Error = fmt.Errorf("failed to export referrers: %w", err)
 		return result
 	}
 
+	// Remember the image for a resumed run
+	if err := h.options.Journal.Record(PhaseExport, registry.URL(), sourceImage, localImage, result.Digest); err != nil {
+		h.logger.Printf("failed to update journal: %v", err)
+	}
+
 	// Log success if verbose
 	if h.options.VerboseLevel > 0 {
-		h.logger.Printf("Successfully exported image: %s -> %s", sourceImage, localImage)
+		h.logger.Printf("Successfully exported image: %s -> %s", result.SourceImage, localImage)
 	}
 
 	return result
@@ -4,10 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
@@ -15,29 +16,44 @@ import (
 type ImportResult struct {
 	LocalImage       string
 	DestinationImage string
+	Digest           string // Manifest pushed to the destination
+	Referrers        int    // Signatures, SBOMs and attestations attached at the destination
+	Retries          int    // Attempts made after the first one failed on a transient error
+	Resumed          bool   // Already imported by a previous run, per the journal
+	Skipped          bool   // The destination tag already pointed to the same manifest
 	Error            error
 }
 
 // ImportOptions contains options for the import process
 type ImportOptions struct {
-	CleanOnError bool
 	VerboseLevel int
-	Credentials  *Credentials
+	Auth         authn.Authenticator // Credentials of the destination registry, resolved on each use (anonymous if nil)
+	StorePath    string              // Local OCI layout directory (default store if empty)
+	Platforms    []v1.Platform       // Platforms kept from multi-platform indexes (all if empty)
+	TLS          TLSOptions          // CA certificates and client certificates of the registries
+	Jobs         int                 // Images imported in parallel (1 if zero)
+	MaxConns     int                 // Connections per registry host (uncapped if zero)
+	Retry        RetryPolicy         // Attempts on transient registry and network errors
+	Journal      *Journal            // Images completed by a previous run, skipped when resuming (nil to disable)
+	Rollback     *Rollback           // Records the artifacts written, to undo them if the run fails (nil to keep them)
+	Force        bool                // Push images even when the destination already has the same manifest
 }
 
 // ImportHandler manages the import of images to a destination registry
 type ImportHandler struct {
-	ctx     context.Context
-	options ImportOptions
-	logger  *log.Logger
+	ctx        context.Context
+	options    ImportOptions
+	logger     *log.Logger
+	transports *hostTransports
 }
 
 // NewImportHandler creates a new ImportHandler instance
 func NewImportHandler(ctx context.Context, options ImportOptions) *ImportHandler {
 	return &ImportHandler{
-		ctx:     ctx,
-		options: options,
-		logger:  log.New(log.Writer(), "[IMPORT] ", log.LstdFlags),
+		ctx:        ctx,
+		options:    options,
+		logger:     log.New(log.Writer(), "[IMPORT] ", log.LstdFlags),
+		transports: newHostTransports(options.TLS, options.MaxConns),
 	}
 }
 
@@ -54,20 +70,48 @@ func (h *ImportHandler) ImportImages(block *Block) <-chan ImportResult {
 			return
 		}
 
+		// Open the local store
+		store, err := OpenStore(h.options.StorePath)
+		if err != nil {
+			results <- ImportResult{Error: fmt.Errorf("failed to open local store: %w", err)}
+			return
+		}
+
 		// Configure authentication
 		auth := h.getAuthConfig(block.DestinationRegistry.Host)
 
-		// Process each image mapping
+		// Collect the image mappings that are not excluded
+		mappings := make([]ImageMapping, 0, len(block.ImageMappings))
 		for _, mapping := range block.ImageMappings {
-			// Skip excluded images
-			if h.isExcluded(mapping.Destination, block.Exclusions) {
-				continue
+			if !isExcluded(mapping, block.Exclusions) {
+				mappings = append(mappings, mapping)
 			}
-
-			// Import image
-			result := h.importSingleImage(mapping.Source, mapping.Destination, auth)
-			results <- result
 		}
+
+		// Import the images, resolved against the destination registry, in
+		// parallel up to the configured number of jobs; results keep the
+		// mapping order
+		runOrdered(h.ctx, h.options.Jobs, mappings,
+			func(mapping ImageMapping) ImportResult {
+				result, retries := withRetry(h.ctx, h.options.Retry, registryHost(block.DestinationRegistry.Host),
+					func(ctx context.Context) ImportResult {
+						return h.importSingleImage(ctx, mapping.Source, mapping.Destination, block.DestinationRegistry, auth, store)
+					},
+					func(result ImportResult) error { return result.Error },
+					func(retry int, delay time.Duration, err error) {
+						if h.options.VerboseLevel > 1 {
+							h.logger.Printf("retrying %s in %s (retry %d): %v", mapping.Destination, delay.Round(time.Millisecond), retry, err)
+						}
+					},
+				)
+				result.Retries = retries
+				return result
+			},
+			func(mapping ImageMapping, err error) ImportResult {
+				return ImportResult{LocalImage: mapping.Source, DestinationImage: block.DestinationRegistry.Qualify(mapping.Destination), Error: err}
+			},
+			func(result ImportResult) { results <- result },
+		)
 	}()
 
 	return results
@@ -92,76 +136,153 @@ func (h *ImportHandler) validateImportBlock(block *Block) error {
 
 // getAuthConfig configures authentication for the registry
 func (h *ImportHandler) getAuthConfig(registryURL string) authn.Authenticator {
-	if h.options.Credentials == nil {
+	if h.options.Auth == nil {
 		return authn.Anonymous
 	}
 
-	return authn.FromConfig(authn.AuthConfig{
-		Username: h.options.Credentials.Username,
-		Password: h.options.Credentials.Password,
-	})
-}
-
-// isExcluded checks if an image is in the exclusion list
-func (h *ImportHandler) isExcluded(image string, exclusions []string) bool {
-	for _, exclusion := range exclusions {
-		if strings.Contains(image, exclusion) {
-			return true
-		}
-	}
-	return false
+	return h.options.Auth
 }
 
 // importSingleImage imports a single image
-func (h *ImportHandler) importSingleImage(localImage, destImage string, auth authn.Authenticator) ImportResult {
+func (h *ImportHandler) importSingleImage(ctx context.Context, localImage, destImage string, registry Registry, auth authn.Authenticator, store *Store) ImportResult {
 	result := ImportResult{
 		LocalImage:       localImage,
-		DestinationImage: destImage,
+		DestinationImage: registry.Qualify(destImage),
 	}
 
-	// Create reference for local image
-	localRef, err := name.ParseReference(localImage)
+	// Create reference for destination image
+	destRef, err := registry.ParseReference(destImage)
 	if err != nil {
-		result.Error = fmt.Errorf("failed to parse local image reference: %w", err)
+		result.Error = fmt.Errorf("failed to parse destination image reference: %w", err)
 		return result
 	}
 
-	// Create reference for destination image
-	destRef, err := name.ParseReference(destImage)
+	// TLS material of the destination registry
+	transport, err := h.transports.get(destRef.Context().RegistryStr())
 	if err != nil {
-		result.Error = fmt.Errorf("failed to parse destination image reference: %w", err)
+		result.Error = fmt.Errorf("failed to configure TLS: %w", err)
 		return result
 	}
 
 	// Options for import
 	opts := []remote.Option{
 		remote.WithAuth(auth),
-		remote.WithContext(h.ctx),
+		remote.WithContext(ctx),
+		remote.WithTransport(transport),
+		remote.WithRetryStatusCodes(), // Retried per image, see withRetry
+	}
+
+	// Skip an image a previous run pushed, if the destination still has it
+	if digest, ok := h.options.Journal.Completed(PhaseImport, registry.URL(), localImage, destImage); ok {
+		if pushed, err := remote.Head(destRef, opts...); err == nil && pushed.Digest.String() == digest {
+			result.Digest = digest
+			result.Resumed = true
+			return result
+		}
 	}
 
-	// Load image from local storage
-	descriptor, err := remote.Get(localRef, opts...)
+	// Look up the local entry
+	desc, err := store.Descriptor(localImage)
 	if err != nil {
 		result.Error = fmt.Errorf("failed to load local image: %w", err)
 		return result
 	}
 
-	// Get image from descriptor
-	img, err := descriptor.Image()
-	if err != nil {
-		result.Error = fmt.Errorf("failed to get image from descriptor: %w", err)
-		return result
+	// Load the local entry; it is pushed once the destination is checked
+	var push func() error
+	if desc.MediaType.IsIndex() {
+		// Load index from local store
+		idx, err := store.ImageIndex(localImage)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to load local index: %w", err)
+			return result
+		}
+
+		if idx, err = filterPlatforms(idx, h.options.Platforms); err != nil {
+			result.Error = err
+			return result
+		}
+
+		// The filtered index is a new manifest
+		if len(h.options.Platforms) > 0 {
+			if desc, err = partial.Descriptor(idx); err != nil {
+				result.Error = fmt.Errorf("failed to describe filtered index: %w", err)
+				return result
+			}
+		}
+
+		// Push index and all its children to destination registry
+		push = func() error {
+			if err := remote.WriteIndex(destRef, idx, opts...); err != nil {
+				return fmt.Errorf("failed to push index: %w", err)
+			}
+			return nil
+		}
+	} else if desc.ArtifactType != "" {
+		// Load artifact from local store
+		artifact, err := store.RawArtifact(localImage)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to load local artifact: %w", err)
+			return result
+		}
+
+		// Push artifact blobs and manifest unchanged to destination registry
+		push = func() error {
+			if err := pushArtifact(destRef, artifact, opts); err != nil {
+				return fmt.Errorf("failed to push artifact: %w", err)
+			}
+			return nil
+		}
+	} else {
+		// Load image from local store
+		img, err := store.Image(localImage)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to load local image: %w", err)
+			return result
+		}
+
+		// Push image to destination registry
+		push = func() error {
+			if err := remote.Write(destRef, img, opts...); err != nil {
+				return fmt.Errorf("failed to push image: %w", err)
+			}
+			return nil
+		}
+	}
+
+	// Leave the destination alone when its tag already points to the manifest
+	if !h.options.Force && isUpToDate(destRef, desc.Digest, opts) {
+		result.Skipped = true
+	} else {
+		// Remember what the tag pointed to, to restore it on failure
+		if err := h.options.Rollback.trackRemote(destRef, desc.Digest, opts); err != nil {
+			result.Error = err
+			return result
+		}
+
+		if err := push(); err != nil {
+			result.Error = err
+			return result
+		}
 	}
 
-	// Push image to destination registry
-	if err := remote.Write(destRef, img, opts...); err != nil {
-		result.Error = fmt.Errorf("failed to push image: %w", err)
+	// Attach the artifacts stored with the image to the pushed manifest
+	if result.Referrers, err = importReferrers(destRef.Context(), *desc, localImage, store, referrerPush{opts: opts, rollback: h.options.Rollback, force: h.options.Force}); err != nil {
+		result.Error = fmt.Errorf("failed to import referrers: %w", err)
 		return result
 	}
+	result.Digest = desc.Digest.String()
+
+	// Remember the image for a resumed run
+	if err := h.options.Journal.Record(PhaseImport, registry.URL(), localImage, destImage, result.Digest); err != nil {
+		h.logger.Printf("failed to update journal: %v", err)
+	}
 
 	// Log success if verbose
-	if h.options.VerboseLevel > 0 {
-		h.logger.Printf("Image imported successfully: %s -> %s", localImage, destImage)
+	if h.options.VerboseLevel > 0 && result.Skipped {
+		h.logger.Printf("Image already up to date: %s", result.DestinationImage)
+	} else if h.options.VerboseLevel > 0 {
+		h.logger.Printf("Image imported successfully: %s -> %s", localImage, result.DestinationImage)
 	}
 
 	return result
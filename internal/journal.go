@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalVersion is the format version of the journal file
+const journalVersion = 1
+
+// Journal records the images completed by a run, so that a run interrupted
+// by a network drop or a signal can be resumed without redoing them. There
+// is one journal per BRMS file, named after a hash of its content: editing
+// the file starts a new journal. Runs of different phases share it, each
+// owning the entries of its own phases.
+type Journal struct {
+	path    string
+	phases  map[TransferPhase]bool
+	mu      sync.Mutex
+	entries map[string]JournalEntry
+}
+
+// JournalEntry is an image operation completed by a previous run
+type JournalEntry struct {
+	Phase     TransferPhase `json:"phase"`
+	Digest    string        `json:"digest"` // Manifest stored or pushed
+	Completed time.Time     `json:"completed"`
+}
+
+// journalFile is the JSON document saved on disk
+type journalFile struct {
+	Version int                     `json:"version"`
+	Entries map[string]JournalEntry `json:"entries"`
+}
+
+// JournalPath returns the journal location of a BRMS file under the user
+// cache directory
+func JournalPath(configPath string) (string, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read configuration: %w", err)
+	}
+
+	return journalPath(data)
+}
+
+// BundleJournalPath returns the journal location of an import from a bundle
+// alone, named after the bundle ID and the BRMS file it carries
+func BundleJournalPath(index *BundleIndex) (string, error) {
+	return journalPath(append([]byte(index.ID+"\n"), index.config...))
+}
+
+// journalPath names a journal after a hash of what identifies the run
+func journalPath(data []byte) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user cache directory: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return filepath.Join(cacheDir, "magina", "journal", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// OpenJournal opens the journal at the given path for a run of the given
+// phases. The entries of a previous run of these phases are kept only when
+// resuming; otherwise the run starts from scratch for them. Entries of other
+// phases are always kept.
+func OpenJournal(path string, resume bool, phases ...TransferPhase) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		phases:  make(map[TransferPhase]bool, len(phases)),
+		entries: make(map[string]JournalEntry),
+	}
+	for _, phase := range phases {
+		j.phases[phase] = true
+	}
+
+	entries, err := readJournal(path)
+	if err != nil {
+		// A journal that cannot be resumed is replaced by a fresh run
+		if resume {
+			return nil, err
+		}
+		return j, nil
+	}
+
+	for key, entry := range entries {
+		if resume || !j.phases[entry.Phase] {
+			j.entries[key] = entry
+		}
+	}
+
+	return j, nil
+}
+
+// readJournal reads the entries of the journal at the given path, none if
+// it does not exist
+func readJournal(path string) (map[string]JournalEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	file := &journalFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %w", path, err)
+	}
+	if file.Version != journalVersion {
+		return nil, fmt.Errorf("unsupported journal version %d in %s", file.Version, path)
+	}
+
+	return file.Entries, nil
+}
+
+// Len returns the number of completed operations recorded for the phases of
+// the run
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	count := 0
+	for _, entry := range j.entries {
+		if j.phases[entry.Phase] {
+			count++
+		}
+	}
+	return count
+}
+
+// Completed returns the digest recorded for an image operation, if a
+// previous run completed it. The registry identifies the block the image
+// belongs to.
+func (j *Journal) Completed(phase TransferPhase, registry, source, destination string) (string, bool) {
+	if j == nil {
+		return "", false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.entries[journalKey(phase, registry, source, destination)]
+	return entry.Digest, ok
+}
+
+// Record saves a completed image operation. The journal is written at once,
+// so that it survives the process being killed.
+func (j *Journal) Record(phase TransferPhase, registry, source, destination, digest string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries[journalKey(phase, registry, source, destination)] = JournalEntry{
+		Phase:     phase,
+		Digest:    digest,
+		Completed: time.Now().UTC(),
+	}
+
+	return j.save()
+}
+
+// Remove drops the entries of the phases of the run once it has completed
+// without failures. The journal file is deleted when no other phase has
+// entries left in it.
+func (j *Journal) Remove() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for key, entry := range j.entries {
+		if j.phases[entry.Phase] {
+			delete(j.entries, key)
+		}
+	}
+
+	if len(j.entries) > 0 {
+		return j.save()
+	}
+
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+
+	return nil
+}
+
+// save writes the journal, the caller holding the lock
+func (j *Journal) save() error {
+	raw, err := json.MarshalIndent(journalFile{
+		Version: journalVersion,
+		Entries: j.entries,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	// Write then rename so that an interrupted save keeps the previous journal
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return nil
+}
+
+// journalKey identifies an image operation in the journal
+func journalKey(phase TransferPhase, registry, source, destination string) string {
+	return fmt.Sprintf("%s %s %s|%s", phase, registry, source, destination)
+}
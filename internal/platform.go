@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// ParsePlatforms parses platform specifications such as "linux/amd64" or "linux/arm64/v8"
+func ParsePlatforms(specs []string) ([]v1.Platform, error) {
+	platforms := make([]v1.Platform, 0, len(specs))
+	for _, spec := range specs {
+		platform, err := v1.ParsePlatform(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %w", spec, err)
+		}
+		platforms = append(platforms, *platform)
+	}
+
+	return platforms, nil
+}
+
+// filterPlatforms removes the index children that match none of the platforms.
+// The index is returned unchanged, with its original digest, when no platform is given.
+func filterPlatforms(idx v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	if len(platforms) == 0 {
+		return idx, nil
+	}
+
+	filtered := mutate.RemoveManifests(idx, func(desc v1.Descriptor) bool {
+		if desc.Platform == nil {
+			return false
+		}
+		for _, platform := range platforms {
+			if desc.Platform.Satisfies(platform) {
+				return false
+			}
+		}
+		return true
+	})
+
+	manifest, err := filtered.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to filter index: %w", err)
+	}
+
+	if len(manifest.Manifests) == 0 {
+		return nil, fmt.Errorf("no manifest matches the requested platforms")
+	}
+
+	return filtered, nil
+}
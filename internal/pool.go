@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// DefaultMaxConnsPerHost caps the connections opened to one registry host
+// when images are processed in parallel
+const DefaultMaxConnsPerHost = 8
+
+// runOrdered processes items with up to jobs concurrent workers and emits
+// their results in the order of the items. Items not yet started when the
+// context is cancelled are handed to skip instead of work.
+func runOrdered[T, R any](ctx context.Context, jobs int, items []T, work func(T) R, skip func(T, error) R, emit func(R)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// One buffered slot per item, so that workers never wait for the emitter
+	slots := make([]chan R, len(items))
+	for i := range slots {
+		slots[i] = make(chan R, 1)
+	}
+
+	go func() {
+		sem := make(chan struct{}, jobs)
+		for i, item := range items {
+			if ctx.Err() == nil {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				slots[i] <- skip(item, err)
+				continue
+			}
+
+			go func(i int, item T) {
+				defer func() { <-sem }()
+				slots[i] <- work(item)
+			}(i, item)
+		}
+	}()
+
+	for _, slot := range slots {
+		emit(<-slot)
+	}
+}
+
+// hostTransports shares one HTTP transport per registry host between the
+// workers of a handler, so that the connection cap applies to all of them
+type hostTransports struct {
+	tls      TLSOptions
+	maxConns int
+	mu       sync.Mutex
+	byHost   map[string]http.RoundTripper
+}
+
+// newHostTransports creates the transports of a handler. A maxConns of
+// zero or less leaves connections uncapped.
+func newHostTransports(tlsOptions TLSOptions, maxConns int) *hostTransports {
+	return &hostTransports{
+		tls:      tlsOptions,
+		maxConns: maxConns,
+		byHost:   make(map[string]http.RoundTripper),
+	}
+}
+
+// get returns the transport of a registry host, creating it on first use
+func (t *hostTransports) get(host string) (http.RoundTripper, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if transport, ok := t.byHost[host]; ok {
+		return transport, nil
+	}
+
+	transport, err := t.tls.Transport(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The default transport is shared process-wide and must not be modified
+	if t.maxConns > 0 {
+		if base, ok := transport.(*http.Transport); ok {
+			capped := base.Clone()
+			capped.MaxConnsPerHost = t.maxConns
+			transport = capped
+		}
+	}
+
+	// Throttled responses tell how long to wait before retrying
+	transport = &retryAfterTransport{inner: transport}
+
+	t.byHost[host] = transport
+	return transport, nil
+}
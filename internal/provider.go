@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// CredentialProviderEnv names the environment variable holding the
+	// default credential provider command
+	CredentialProviderEnv = "MAGINA_CREDENTIAL_PROVIDER"
+
+	// providerTimeout bounds a single run of the credential provider
+	providerTimeout = 30 * time.Second
+
+	// expiryMargin renews credentials shortly before they expire, so that
+	// they do not lapse in the middle of a request
+	expiryMargin = 30 * time.Second
+)
+
+// CredentialProvider runs an external executable that returns registry
+// credentials, in the manner of Kubernetes exec credential plugins. The
+// registry host is written to its stdin and it answers with a JSON
+// providerResponse on stdout. The role is passed in $MAGINA_ROLE.
+type CredentialProvider struct {
+	command string
+	args    []string
+}
+
+// providerResponse is the JSON document printed by a credential provider.
+// An empty document means the provider has no credentials for the registry.
+type providerResponse struct {
+	Username      string     `json:"username,omitempty"`
+	Password      string     `json:"password,omitempty"`
+	IdentityToken string     `json:"identityToken,omitempty"`
+	RegistryToken string     `json:"registryToken,omitempty"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+}
+
+// NewCredentialProvider creates a provider from a command line such as
+// "/usr/local/bin/vault-registry-creds --role ci"
+func NewCredentialProvider(commandLine string) (*CredentialProvider, error) {
+	fields := strings.Fields(commandLine)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty credential provider command")
+	}
+
+	return &CredentialProvider{
+		command: fields[0],
+		args:    fields[1:],
+	}, nil
+}
+
+// Credentials runs the provider for a registry host, which may carry a
+// repository prefix. It returns nil when the provider has no credentials
+// for it.
+func (p *CredentialProvider) Credentials(ctx context.Context, role Role, registryURL string) (*Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, providerTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command, p.args...)
+	cmd.Stdin = strings.NewReader(registryURL + "\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "MAGINA_REGISTRY="+registryURL, "MAGINA_ROLE="+string(role))
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("credential provider failed for %s: %w: %s", registryURL, err, message)
+		}
+		return nil, fmt.Errorf("credential provider failed for %s: %w", registryURL, err)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, nil
+	}
+
+	response := &providerResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), response); err != nil {
+		return nil, fmt.Errorf("invalid credential provider response for %s: %w", registryURL, err)
+	}
+
+	var creds *Credentials
+	switch {
+	case response.Password != "":
+		creds = NewCredentials(response.Username, response.Password)
+	case response.RegistryToken != "":
+		creds = NewTokenCredentials(response.Username, response.RegistryToken, TokenBearer)
+	case response.IdentityToken != "":
+		creds = NewTokenCredentials(response.Username, response.IdentityToken, TokenIdentity)
+	default:
+		return nil, nil
+	}
+
+	if response.ExpiresAt != nil {
+		creds.ExpiresAt = *response.ExpiresAt
+	}
+
+	return creds, nil
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/authn/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// LoadPullSecrets reads Kubernetes image pull secrets and returns a keychain
+// resolving credentials per registry host from them. Each file holds either a
+// Secret manifest of type kubernetes.io/dockerconfigjson or
+// kubernetes.io/dockercfg, in YAML or JSON, or a raw .dockerconfigjson.
+func LoadPullSecrets(paths []string) (authn.Keychain, error) {
+	secrets := make([]corev1.Secret, 0, len(paths))
+	for _, path := range paths {
+		secret, err := readPullSecret(path)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, *secret)
+	}
+
+	keychain, err := kubernetes.NewFromPullSecrets(context.Background(), secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pull secrets: %w", err)
+	}
+
+	return keychain, nil
+}
+
+// readPullSecret reads one pull secret file
+func readPullSecret(path string) (*corev1.Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pull secret: %w", err)
+	}
+
+	// YAML is a superset of JSON, so both formats go through the same path
+	raw, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pull secret %s: %w", path, err)
+	}
+
+	// A raw .dockerconfigjson has an "auths" object and no kind
+	var probe struct {
+		Kind  string          `json:"kind"`
+		Auths json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse pull secret %s: %w", path, err)
+	}
+
+	if probe.Kind == "" && probe.Auths != nil {
+		return &corev1.Secret{
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: raw},
+		}, nil
+	}
+
+	if probe.Kind != "Secret" {
+		return nil, fmt.Errorf("pull secret %s is neither a Secret nor a .dockerconfigjson", path)
+	}
+
+	secret := &corev1.Secret{}
+	if err := json.Unmarshal(raw, secret); err != nil {
+		return nil, fmt.Errorf("failed to parse pull secret %s: %w", path, err)
+	}
+
+	// stringData is only merged into data by the API server
+	for key, value := range secret.StringData {
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[key] = []byte(value)
+	}
+
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		if _, ok := secret.Data[corev1.DockerConfigJsonKey]; !ok {
+			return nil, fmt.Errorf("pull secret %s has no %s key", path, corev1.DockerConfigJsonKey)
+		}
+	case corev1.SecretTypeDockercfg:
+		if _, ok := secret.Data[corev1.DockerConfigKey]; !ok {
+			return nil, fmt.Errorf("pull secret %s has no %s key", path, corev1.DockerConfigKey)
+		}
+	default:
+		return nil, fmt.Errorf("pull secret %s has type %q, expected %s or %s", path, secret.Type, corev1.SecretTypeDockerConfigJson, corev1.SecretTypeDockercfg)
+	}
+
+	return secret, nil
+}
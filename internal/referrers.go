@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// cosignTagSuffixes are the suffixes of the tags cosign uses to attach
+// signatures, attestations and SBOMs to an image
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// referrerTag returns the tag-scheme name of an artifact attached to the
+// given digest, e.g. "sha256-<hex>.sig"
+func referrerTag(digest v1.Hash, suffix string) string {
+	return fmt.Sprintf("%s-%s%s", digest.Algorithm, digest.Hex, suffix)
+}
+
+// isReferrerTag reports whether a tag follows the cosign scheme, naming the
+// artifact attached to another manifest rather than an image of its own
+func isReferrerTag(tag string) bool {
+	for _, suffix := range cosignTagSuffixes {
+		subject, found := strings.CutSuffix(tag, suffix)
+		if !found {
+			continue
+		}
+		if _, err := v1.NewHash(strings.Replace(subject, "-", ":", 1)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// exportReferrers copies the artifacts attached to a source manifest into the
+// store, under the reference name of their subject. Both the OCI referrers API
+// and the cosign tag scheme are looked up; the logger, if not nil, is told
+// of a registry without referrers support.
+func exportReferrers(repo name.Repository, subject v1.Hash, localImage string, store *Store, opts []remote.Option, logger *log.Logger) (int, error) {
+	if err := store.RemoveReferrers(localImage); err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	// OCI 1.1 referrers, with the registry's own tag fallback
+	manifest, err := listReferrers(repo.Digest(subject.String()), opts, logger)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, desc := range manifest.Manifests {
+		artifact, err := remote.Get(repo.Digest(desc.Digest.String()), opts...)
+		if err != nil {
+			return count, fmt.Errorf("failed to load referrer %s: %w", desc.Digest, err)
+		}
+		if err := storeReferrer(repo, artifact, localImage, "", store, opts); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	// Cosign tag scheme
+	for _, suffix := range cosignTagSuffixes {
+		artifact, err := remote.Get(repo.Tag(referrerTag(subject, suffix)), opts...)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to load %s artifact: %w", suffix, err)
+		}
+		if err := storeReferrer(repo, artifact, localImage, suffix, store, opts); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// listReferrers lists the OCI referrers of a manifest. A registry rejecting
+// the referrers API and its tag fallback, as read-only mirrors may, is taken
+// as having none; this is reported to the logger when it is not nil.
+func listReferrers(subject name.Digest, opts []remote.Option, logger *log.Logger) (*v1.IndexManifest, error) {
+	index, err := remote.Referrers(subject, opts...)
+	if isNotFound(err) || isUnsupported(err) {
+		if logger != nil {
+			logger.Printf("%s: referrers not supported by the registry: %v", subject.Context(), err)
+		}
+		return &v1.IndexManifest{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// storeReferrer writes a fetched artifact to the store
+func storeReferrer(repo name.Repository, artifact *remote.Descriptor, subjectRef, tagSuffix string, store *Store, opts []remote.Option) error {
+	if artifact.MediaType.IsIndex() {
+		idx, err := artifact.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("failed to read referrer %s: %w", artifact.Digest, err)
+		}
+		if err := store.WriteReferrer(subjectRef, tagSuffix, idx); err != nil {
+			return fmt.Errorf("failed to save referrer %s locally: %w", artifact.Digest, err)
+		}
+		return nil
+	}
+
+	raw, err := newRemoteArtifact(repo, artifact, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read referrer %s: %w", artifact.Digest, err)
+	}
+	if err := store.WriteReferrer(subjectRef, tagSuffix, raw); err != nil {
+		return fmt.Errorf("failed to save referrer %s locally: %w", artifact.Digest, err)
+	}
+
+	return nil
+}
+
+// importReferrers pushes the artifacts stored with a local image and attaches
+// them to the destination manifest. Tag-scheme artifacts are tagged after the
+// destination digest; OCI referrers get their subject rewritten when the
+// destination digest differs from the one they were attached to.
+func importReferrers(repo name.Repository, subject v1.Descriptor, localImage string, store *Store, to referrerPush) (int, error) {
+	referrers, err := store.Referrers(localImage)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, desc := range referrers {
+		artifact, err := store.Artifact(desc)
+		if err != nil {
+			return i, fmt.Errorf("failed to load local referrer %s: %w", desc.Digest, err)
+		}
+
+		// Tag-scheme artifact
+		if suffix := desc.Annotations[referrerTagAnnotation]; suffix != "" {
+			tag := repo.Tag(referrerTag(subject.Digest, suffix))
+			if err := to.push(tag, desc.Digest, artifact); err != nil {
+				return i, fmt.Errorf("failed to push %s artifact: %w", suffix, err)
+			}
+			continue
+		}
+
+		// OCI referrer, re-attached to the destination digest if needed
+		if attached, err := subjectOf(artifact); err != nil {
+			return i, err
+		} else if attached == nil || *attached != subject.Digest {
+			artifact = withSubject(artifact, subject)
+		}
+
+		digest, err := artifact.Digest()
+		if err != nil {
+			return i, fmt.Errorf("failed to compute referrer digest: %w", err)
+		}
+		if err := to.push(repo.Digest(digest.String()), digest, artifact); err != nil {
+			return i, fmt.Errorf("failed to push referrer %s: %w", digest, err)
+		}
+	}
+
+	return len(referrers), nil
+}
+
+// copyReferrers copies the artifacts attached to a source manifest straight
+// to the destination repository, attached to the destination manifest, as
+// exportReferrers followed by importReferrers would
+func copyReferrers(src name.Repository, subject v1.Hash, dst name.Repository, target v1.Descriptor, srcOpts []remote.Option, to referrerPush, logger *log.Logger) (int, error) {
+	count := 0
+
+	// OCI 1.1 referrers, with the registry's own tag fallback
+	manifest, err := listReferrers(src.Digest(subject.String()), srcOpts, logger)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, desc := range manifest.Manifests {
+		artifact, err := remoteReferrer(src.Digest(desc.Digest.String()), srcOpts)
+		if err != nil {
+			return count, err
+		}
+
+		if attached, err := subjectOf(artifact); err != nil {
+			return count, err
+		} else if attached == nil || *attached != target.Digest {
+			artifact = withSubject(artifact, target)
+		}
+
+		digest, err := artifact.Digest()
+		if err != nil {
+			return count, fmt.Errorf("failed to compute referrer digest: %w", err)
+		}
+		if err := to.push(dst.Digest(digest.String()), digest, artifact); err != nil {
+			return count, fmt.Errorf("failed to push referrer %s: %w", digest, err)
+		}
+		count++
+	}
+
+	// Cosign tag scheme
+	for _, suffix := range cosignTagSuffixes {
+		artifact, err := remoteReferrer(src.Tag(referrerTag(subject, suffix)), srcOpts)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		digest, err := artifact.Digest()
+		if err != nil {
+			return count, fmt.Errorf("failed to compute referrer digest: %w", err)
+		}
+		tag := dst.Tag(referrerTag(target.Digest, suffix))
+		if err := to.push(tag, digest, artifact); err != nil {
+			return count, fmt.Errorf("failed to push %s artifact: %w", suffix, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// remoteReferrer fetches an artifact from a registry as an image or an index,
+// whose blobs are streamed or mounted when it is pushed elsewhere
+func remoteReferrer(ref name.Reference, opts []remote.Option) (taggableArtifact, error) {
+	descriptor, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load referrer %s: %w", ref, err)
+	}
+
+	if descriptor.MediaType.IsIndex() {
+		return descriptor.ImageIndex()
+	}
+	return descriptor.Image()
+}
+
+// referrerPush pushes referrers to a destination repository
+type referrerPush struct {
+	opts     []remote.Option
+	rollback *Rollback
+	force    bool // Push artifacts the destination already has
+}
+
+// push writes an artifact under a tag or its digest, unless the reference
+// already points to it
+func (p referrerPush) push(ref name.Reference, digest v1.Hash, artifact remote.Taggable) error {
+	if !p.force && isUpToDate(ref, digest, p.opts) {
+		return nil
+	}
+	if err := p.rollback.trackRemote(ref, digest, p.opts); err != nil {
+		return err
+	}
+	return remote.Push(ref, artifact, p.opts...)
+}
+
+// isUpToDate reports whether a registry reference already points to the
+// manifest with the given digest. Lookup errors count as not up to date, the
+// push reporting them if they persist.
+func isUpToDate(ref name.Reference, digest v1.Hash, opts []remote.Option) bool {
+	desc, err := remote.Head(ref, opts...)
+	return err == nil && desc.Digest == digest
+}
+
+// subjectOf returns the subject digest recorded in an artifact manifest
+func subjectOf(artifact remote.Taggable) (*v1.Hash, error) {
+	raw, err := artifact.RawManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read referrer manifest: %w", err)
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse referrer manifest: %w", err)
+	}
+
+	if manifest.Subject == nil {
+		return nil, nil
+	}
+
+	return &manifest.Subject.Digest, nil
+}
+
+// withSubject points an artifact at a new subject manifest
+func withSubject(artifact taggableArtifact, subject v1.Descriptor) taggableArtifact {
+	return mutate.Subject(artifact, v1.Descriptor{
+		MediaType: subject.MediaType,
+		Size:      subject.Size,
+		Digest:    subject.Digest,
+	}).(taggableArtifact)
+}
+
+// taggableArtifact is an image or an index read from the store
+type taggableArtifact interface {
+	remote.Taggable
+	Digest() (v1.Hash, error)
+}
+
+// isNotFound reports whether a registry error is a 404
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
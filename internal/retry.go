@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// maxRetryAfter is the longest Retry-After delay honoured; a registry asking
+// for more fails the image rather than stalling the run
+const maxRetryAfter = 5 * time.Minute
+
+// retryableStatusCodes are the registry responses worth another attempt
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// RetryPolicy tells how an image operation that failed on a transient
+// error is attempted again
+type RetryPolicy struct {
+	MaxAttempts int            // Attempts per image, including the first (1 disables retries)
+	Backoff     time.Duration  // Delay before the first retry, doubled after each one
+	MaxBackoff  time.Duration  // Upper bound of the delay, Retry-After excepted
+	Hosts       map[string]int // MaxAttempts overrides per registry host
+}
+
+// DefaultRetryPolicy returns the policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Second,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+// attempts returns the number of attempts allowed against a registry host
+func (p RetryPolicy) attempts(host string) int {
+	if attempts, ok := p.Hosts[host]; ok {
+		return max(attempts, 1)
+	}
+	return max(p.MaxAttempts, 1)
+}
+
+// between returns the policy of an operation involving two registry hosts,
+// allowed the larger number of attempts of the two
+func (p RetryPolicy) between(source, destination string) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: max(p.attempts(source), p.attempts(destination)),
+		Backoff:     p.Backoff,
+		MaxBackoff:  p.MaxBackoff,
+	}
+}
+
+// delay returns the jittered exponential backoff before the given retry
+// (1 for the first one). The delay is drawn between half and all of the
+// nominal backoff, so that parallel jobs do not retry in lockstep.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// withRetry runs an operation until it succeeds, fails on a permanent error
+// or runs out of attempts. It returns the last result and the number of
+// retries made. onRetry is called before each wait.
+func withRetry[R any](ctx context.Context, policy RetryPolicy, host string, op func(context.Context) R, failed func(R) error, onRetry func(retry int, delay time.Duration, err error)) (R, int) {
+	attempts := policy.attempts(host)
+
+	for retry := 0; ; retry++ {
+		hints := &retryHints{}
+		result := op(context.WithValue(ctx, retryHintsKey{}, hints))
+
+		err := failed(result)
+		if err == nil || retry+1 >= attempts || !isRetryable(err) || ctx.Err() != nil {
+			return result, retry
+		}
+
+		// The registry's Retry-After wins over a shorter backoff
+		delay := policy.delay(retry + 1)
+		if after := hints.retryAfter(); after > maxRetryAfter {
+			return result, retry
+		} else if after > delay {
+			delay = after
+		}
+
+		if onRetry != nil {
+			onRetry(retry+1, delay, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, retry
+		}
+	}
+}
+
+// isRetryable reports whether an error is transient: a retryable registry
+// status, a network failure or a connection cut in the middle of a transfer
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return retryableStatusCodes[terr.StatusCode]
+	}
+
+	// An unknown host will not appear by waiting
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+
+	// Neither will a certificate or TLS setup the registry rejects
+	if isTLSError(err) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isTLSError reports whether an error is a certificate or TLS handshake
+// failure. Those are wrapped in the *url.Error of the request, itself a
+// net.Error, and must be told apart before it.
+func isTLSError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		errors.As(err, &recordErr)
+}
+
+// retryHintsKey is the context key of the retryHints of an attempt
+type retryHintsKey struct{}
+
+// retryHints collects the Retry-After delays registries answered with during
+// one attempt. The go-containerregistry errors do not carry the response
+// headers, so they are read on the way by retryAfterTransport.
+type retryHints struct {
+	mu    sync.Mutex
+	after time.Duration
+}
+
+// note records a Retry-After delay, keeping the longest
+func (h *retryHints) note(after time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.after = max(h.after, after)
+}
+
+// retryAfter returns the longest Retry-After delay seen
+func (h *retryHints) retryAfter() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.after
+}
+
+// retryAfterTransport notes the Retry-After header of throttled responses in
+// the retryHints of the request context
+type retryAfterTransport struct {
+	inner http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if hints, ok := req.Context().Value(retryHintsKey{}).(*retryHints); ok {
+			if after := parseRetryAfter(resp.Header.Get("Retry-After")); after > 0 {
+				hints.note(after)
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// parseRetryAfter parses a Retry-After header, given in seconds or as an
+// HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
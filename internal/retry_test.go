@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestIsRetryable(t *testing.T) {
+	// wrap returns the error as the HTTP client reports it
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: err}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttled", &transport.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"unavailable", &transport.Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{"unauthorized", &transport.Error{StatusCode: http.StatusUnauthorized}, false},
+		{"not found", &transport.Error{StatusCode: http.StatusNotFound}, false},
+		{"canceled", wrap(context.Canceled), false},
+		{"deadline exceeded", wrap(context.DeadlineExceeded), false},
+		{"unknown host", wrap(&net.DNSError{Err: "no such host", Name: "registry.example.com", IsNotFound: true}), false},
+		{"connection refused", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{"connection reset", fmt.Errorf("copying blob: %w", syscall.ECONNRESET), true},
+		{"transfer cut", fmt.Errorf("copying blob: %w", io.ErrUnexpectedEOF), true},
+		{"certificate verification", wrap(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), false},
+		{"unknown authority", wrap(x509.UnknownAuthorityError{}), false},
+		{"hostname mismatch", wrap(x509.HostnameError{Host: "registry.example.com"}), false},
+		{"invalid certificate", wrap(x509.CertificateInvalidError{Reason: x509.Expired}), false},
+		{"plain HTTP answer to TLS", wrap(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), false},
+		{"other error", errors.New("invalid manifest"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
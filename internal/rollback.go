@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// CleanupAction tells how an artifact written by a failed run was undone
+type CleanupAction string
+
+const (
+	CleanupRemoved  CleanupAction = "removed"  // The artifact did not exist before the run
+	CleanupRestored CleanupAction = "restored" // The reference points to its previous target again
+)
+
+// CleanupResult reports the rollback of one artifact
+type CleanupResult struct {
+	Artifact string
+	Action   CleanupAction
+	Error    error
+}
+
+// Rollback records the artifacts a run writes, local store entries and
+// registry manifests, with their state before the run, so that they can be
+// undone when the run fails. It is safe for concurrent use; the methods of a
+// nil Rollback do nothing.
+type Rollback struct {
+	mu      sync.Mutex
+	tracked map[string]bool
+	actions []rollbackAction
+}
+
+// rollbackAction undoes one artifact
+type rollbackAction struct {
+	artifact string
+	action   CleanupAction
+	undo     func(context.Context) error
+}
+
+// NewRollback creates an empty Rollback
+func NewRollback() *Rollback {
+	return &Rollback{tracked: make(map[string]bool)}
+}
+
+// Len returns the number of artifacts recorded
+func (r *Rollback) Len() int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.actions)
+}
+
+// Undo reverts the recorded artifacts, the latest first, and forgets them.
+// Every artifact is attempted even when undoing another one failed.
+func (r *Rollback) Undo(ctx context.Context) []CleanupResult {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	actions := r.actions
+	r.actions = nil
+	r.tracked = make(map[string]bool)
+	r.mu.Unlock()
+
+	results := make([]CleanupResult, 0, len(actions))
+	for i := len(actions) - 1; i >= 0; i-- {
+		action := actions[i]
+		results = append(results, CleanupResult{
+			Artifact: action.artifact,
+			Action:   action.action,
+			Error:    action.undo(ctx),
+		})
+	}
+
+	return results
+}
+
+// isTracked reports whether an artifact is already recorded. Only the state
+// before the first write counts: a retried image must not record its own
+// partial output.
+func (r *Rollback) isTracked(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.tracked[key]
+}
+
+// add records how to undo an artifact, unless it is already recorded
+func (r *Rollback) add(key, artifact string, action CleanupAction, undo func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tracked[key] {
+		return
+	}
+	r.tracked[key] = true
+	r.actions = append(r.actions, rollbackAction{artifact: artifact, action: action, undo: undo})
+}
+
+// trackStore records the entries of a reference name in a local store before
+// they are written
+func (r *Rollback) trackStore(store *Store, ref string) error {
+	key := "store " + store.Path() + " " + ref
+	if r == nil || r.isTracked(key) {
+		return nil
+	}
+
+	previous, err := store.Snapshot(ref)
+	if err != nil {
+		return fmt.Errorf("failed to record %s for cleanup: %w", ref, err)
+	}
+
+	action := CleanupRemoved
+	if len(previous) > 0 {
+		action = CleanupRestored
+	}
+
+	r.add(key, fmt.Sprintf("%s (%s)", ref, store.Path()), action, func(context.Context) error {
+		return store.Restore(ref, previous)
+	})
+
+	return nil
+}
+
+// trackRemote records the state of a registry reference before the manifest
+// with the given digest is pushed to it. Undoing it tags the previous
+// manifest again, and deletes the pushed manifest unless it already existed.
+// Blobs and the platform manifests of an index are left to the registry
+// garbage collector.
+func (r *Rollback) trackRemote(ref name.Reference, digest v1.Hash, opts []remote.Option) error {
+	key := "remote " + ref.Name()
+	if r == nil || r.isTracked(key) {
+		return nil
+	}
+
+	// Whether the manifest was already in the repository, under any tag
+	existed := true
+	if _, err := remote.Head(ref.Context().Digest(digest.String()), opts...); isNotFound(err) {
+		existed = false
+	} else if err != nil {
+		return fmt.Errorf("failed to record %s for cleanup: %w", ref, err)
+	}
+
+	// The manifest the tag pointed to
+	var previous *remote.Descriptor
+	tag, isTag := ref.(name.Tag)
+	if isTag {
+		desc, err := remote.Get(tag, opts...)
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to record %s for cleanup: %w", ref, err)
+		}
+		if err == nil && desc.Digest != digest {
+			previous = desc
+		} else if err == nil {
+			isTag = false // The tag already points to this manifest
+		}
+	}
+
+	undoOpts := func(ctx context.Context) []remote.Option {
+		return append(slices.Clone(opts), remote.WithContext(ctx))
+	}
+	pushed := ref.Context().Digest(digest.String())
+
+	switch {
+	case previous != nil:
+		r.add(key, ref.Name(), CleanupRestored, func(ctx context.Context) error {
+			if err := remote.Tag(tag, previous, undoOpts(ctx)...); err != nil {
+				return fmt.Errorf("failed to restore %s to %s: %w", ref, previous.Digest, err)
+			}
+			if !existed {
+				if err := remote.Delete(pushed, undoOpts(ctx)...); err != nil {
+					return fmt.Errorf("failed to delete %s: %w", pushed, err)
+				}
+			}
+			return nil
+		})
+	case !existed:
+		// Deleting the new manifest removes the tags pointing to it
+		r.add(key, ref.Name(), CleanupRemoved, func(ctx context.Context) error {
+			if err := remote.Delete(pushed, undoOpts(ctx)...); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", pushed, err)
+			}
+			return nil
+		})
+	case isTag:
+		// A new tag on a manifest that existed before
+		r.add(key, ref.Name(), CleanupRemoved, func(ctx context.Context) error {
+			if err := remote.Delete(tag, undoOpts(ctx)...); err != nil {
+				return fmt.Errorf("failed to delete tag %s: %w", ref, err)
+			}
+			return nil
+		})
+	}
+
+	return nil
+}
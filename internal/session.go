@@ -2,57 +2,273 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/term"
+)
+
+// Role tells whether credentials are used to read from or push to a registry
+type Role string
+
+const (
+	RoleSource      Role = "source"
+	RoleDestination Role = "destination"
 )
 
+// ParseRole parses a role given on the command line. An empty value means
+// the credentials serve both roles.
+func ParseRole(value string) (Role, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return "", nil
+	case "source", "src":
+		return RoleSource, nil
+	case "destination", "dst":
+		return RoleDestination, nil
+	default:
+		return "", fmt.Errorf("invalid role %q: expected %s or %s", value, RoleSource, RoleDestination)
+	}
+}
+
+// envSuffix returns the suffix of the role-specific environment variables
+func (r Role) envSuffix() string {
+	if r == RoleDestination {
+		return "DST"
+	}
+	return "SRC"
+}
+
+// AuthError reports that no credentials could be obtained for a registry
+// without asking the user
+type AuthError struct {
+	Registry string
+	Reason   string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication required for %s: %s", e.Registry, e.Reason)
+}
+
+// credentialKey identifies cached credentials. The registry may carry a
+// repository prefix, so that two projects of one host, or the two ends of a
+// copy within one host, can use different principals.
+type credentialKey struct {
+	role     Role
+	registry string
+}
+
 // Session represents a session of the application
 // that maintains credentials in memory
 type Session struct {
-	credentials map[string]*Credentials
-	mu          sync.RWMutex
+	credentials    map[credentialKey]*Credentials
+	explicit       map[Role]*Credentials // Credentials given on the command line
+	store          *CredentialStore      // Credentials saved by magina login
+	provider       *CredentialProvider   // External credential executable
+	pullSecrets    authn.Keychain        // Kubernetes image pull secrets
+	nonInteractive bool
+	mu             sync.RWMutex
 }
 
 // NewSession creates a new session
 func NewSession() *Session {
 	return &Session{
-		credentials: make(map[string]*Credentials),
+		credentials: make(map[credentialKey]*Credentials),
+		explicit:    make(map[Role]*Credentials),
 	}
 }
 
-// GetCredentials retrieves the credentials for a registry
-// If the credentials do not exist, asks the user
-func (s *Session) GetCredentials(registryURL string) (*Credentials, error) {
+// SetExplicitCredentials sets the credentials given on the command line for
+// a role. They take precedence over every other source.
+func (s *Session) SetExplicitCredentials(role Role, creds *Credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.explicit[role] = creds
+}
+
+// SetCredentialStore sets the persistent store looked up before prompting
+func (s *Session) SetCredentialStore(store *CredentialStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = store
+}
+
+// SetCredentialProvider sets the external executable asked for credentials
+// before any other source but the command line
+func (s *Session) SetCredentialProvider(provider *CredentialProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.provider = provider
+}
+
+// SetPullSecrets sets the keychain built from Kubernetes pull secrets
+func (s *Session) SetPullSecrets(keychain authn.Keychain) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pullSecrets = keychain
+}
+
+// SetNonInteractive disables the interactive prompt: missing credentials
+// then fail with an AuthError
+func (s *Session) SetNonInteractive(nonInteractive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nonInteractive = nonInteractive
+}
+
+// GetCredentials retrieves the credentials for a registry used in the given role.
+// The registry may carry a repository prefix, e.g. harbor.example.com/project-a.
+// Sources are tried in order: command line, credential provider, pull
+// secrets, environment variables, Docker config and credential helpers, the magina
+// credential store, then the user is asked. Credentials are cached per role
+// and registry; expiring ones are resolved again once they expire. The
+// context bounds the run of the credential provider.
+func (s *Session) GetCredentials(ctx context.Context, role Role, registryURL string) (*Credentials, error) {
+	key := credentialKey{role: role, registry: registryURL}
+
 	s.mu.RLock()
-	creds, exists := s.credentials[registryURL]
+	creds, exists := s.credentials[key]
+	explicit := s.explicit[role]
 	s.mu.RUnlock()
 
-	if exists {
+	if explicit != nil {
+		return explicit, nil
+	}
+
+	if exists && !creds.Expired() {
 		return creds, nil
 	}
 
-	// Ask the user for credentials
-	creds, err := s.promptCredentials(registryURL)
+	creds, err := s.resolveCredentials(ctx, role, registryURL)
 	if err != nil {
 		return nil, err
 	}
 
 	// Store the credentials in memory
 	s.mu.Lock()
-	s.credentials[registryURL] = creds
+	s.credentials[key] = creds
 	s.mu.Unlock()
 
 	return creds, nil
 }
 
-// promptCredentials asks the user for credentials
-func (s *Session) promptCredentials(registryURL string) (*Credentials, error) {
+// Authenticator returns an authenticator for a registry used in the given
+// role. It asks the session for the credentials on every authorization, so
+// that expiring ones are renewed in the middle of a long run.
+func (s *Session) Authenticator(ctx context.Context, role Role, registryURL string) authn.Authenticator {
+	return &sessionAuthenticator{ctx: ctx, session: s, role: role, registry: registryURL}
+}
+
+// sessionAuthenticator resolves the credentials of a role through the session
+type sessionAuthenticator struct {
+	ctx      context.Context
+	session  *Session
+	role     Role
+	registry string
+}
+
+// Authorization implements authn.Authenticator
+func (a *sessionAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	return a.AuthorizationContext(a.ctx)
+}
+
+// AuthorizationContext implements authn.ContextAuthenticator
+func (a *sessionAuthenticator) AuthorizationContext(ctx context.Context) (*authn.AuthConfig, error) {
+	creds, err := a.session.GetCredentials(ctx, a.role, a.registry)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		return &authn.AuthConfig{}, nil
+	}
+
+	config := creds.AuthConfig()
+	return &config, nil
+}
+
+// resolveCredentials walks the credential sources for a registry
+func (s *Session) resolveCredentials(ctx context.Context, role Role, registryURL string) (*Credentials, error) {
+	s.mu.RLock()
+	provider := s.provider
+	pullSecrets := s.pullSecrets
+	s.mu.RUnlock()
+
+	if provider != nil {
+		creds, err := provider.Credentials(ctx, role, registryURL)
+		if err != nil {
+			return nil, &AuthError{Registry: registryURL, Reason: err.Error()}
+		}
+		if creds != nil {
+			return creds, nil
+		}
+	}
+
+	if pullSecrets != nil {
+		creds, err := credentialsFromKeychain(pullSecrets, registryURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pull secrets: %w", err)
+		}
+		if creds != nil {
+			return creds, nil
+		}
+	}
+
+	if creds, err := roleCredentialsFromEnv(role, registryURL); err == nil {
+		return creds, nil
+	}
+
+	creds, err := credentialsFromDockerConfig(registryURL)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		return creds, nil
+	}
+
+	s.mu.RLock()
+	store := s.store
+	s.mu.RUnlock()
+
+	if store != nil && store.Exists() {
+		creds, err := store.Lookup(role, registryURL)
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			return creds, nil
+		}
+	}
+
+	// Ask the user for credentials, only when someone can answer
+	s.mu.RLock()
+	nonInteractive := s.nonInteractive
+	s.mu.RUnlock()
+
+	if nonInteractive {
+		return nil, &AuthError{Registry: registryURL, Reason: "no credentials found and non-interactive mode is enabled"}
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, &AuthError{Registry: registryURL, Reason: "no credentials found and stdin is not a terminal"}
+	}
+
+	return PromptCredentials(fmt.Sprintf("%s (%s)", registryURL, role))
+}
+
+// PromptCredentials asks the user for credentials, without echoing the password
+func PromptCredentials(registryURL string) (*Credentials, error) {
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Printf("Authentication required for %s\n", registryURL)
-	
+
 	fmt.Print("Username: ")
 	username, err := reader.ReadString('\n')
 	if err != nil {
@@ -61,23 +277,20 @@ func (s *Session) promptCredentials(registryURL string) (*Credentials, error) {
 	username = strings.TrimSpace(username)
 
 	fmt.Print("Password: ")
-	password, err := reader.ReadString('\n')
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println() // New line after password
 	if err != nil {
 		return nil, fmt.Errorf("failed to read password: %w", err)
 	}
-	password = strings.TrimSpace(password)
 
-	return &Credentials{
-		Username: username,
-		Password: password,
-	}, nil
+	return NewCredentials(username, strings.TrimSpace(string(password))), nil
 }
 
 // Clear clears all credentials from the session
 func (s *Session) Clear() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	
+
 	// Clear the credentials map
-	s.credentials = make(map[string]*Credentials)
+	s.credentials = make(map[credentialKey]*Credentials)
 }
@@ -0,0 +1,705 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+const (
+	// refNameAnnotation is the OCI annotation used to name images in the layout index
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+
+	// referrerOfAnnotation names the image an artifact (signature, SBOM,
+	// attestation) is attached to in the layout index
+	referrerOfAnnotation = "io.github.caezarr-oss.magina.referrer.of"
+
+	// referrerTagAnnotation holds the cosign tag suffix (".sig", ".att",
+	// ".sbom") of artifacts attached with the tag scheme
+	referrerTagAnnotation = "io.github.caezarr-oss.magina.referrer.tag"
+)
+
+// Store represents a local OCI image layout directory. It is safe for
+// concurrent use: blobs are written atomically and updates of the layout
+// index are serialized.
+type Store struct {
+	path layout.Path
+	mu   sync.RWMutex // Guards index.json, which is rewritten in place
+}
+
+// DefaultStorePath returns the default location of the local store
+// under the user cache directory
+func DefaultStorePath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user cache directory: %w", err)
+	}
+
+	return filepath.Join(cacheDir, "magina", "store"), nil
+}
+
+// OpenStore opens the OCI image layout at the given path, creating it if needed.
+// An empty path selects the default store location.
+func OpenStore(storePath string) (*Store, error) {
+	if storePath == "" {
+		defaultPath, err := DefaultStorePath()
+		if err != nil {
+			return nil, err
+		}
+		storePath = defaultPath
+	}
+
+	// Reuse an existing layout
+	if p, err := layout.FromPath(storePath); err == nil {
+		return &Store{path: p}, nil
+	}
+
+	// Initialize a new empty layout
+	if err := os.MkdirAll(storePath, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	p, err := layout.Write(storePath, empty.Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize OCI layout: %w", err)
+	}
+
+	return &Store{path: p}, nil
+}
+
+// Path returns the directory of the store
+func (s *Store) Path() string {
+	return string(s.path)
+}
+
+// WriteImage writes an image to the store under the given reference name,
+// replacing any image previously stored under that name
+func (s *Store) WriteImage(ref string, img v1.Image) error {
+	if err := s.writeImageBlobs(img); err != nil {
+		return err
+	}
+
+	return s.putManifest(img, map[string]string{refNameAnnotation: ref})
+}
+
+// WriteIndex writes an image index and all its children to the store under
+// the given reference name, replacing any entry previously stored under that name
+func (s *Store) WriteIndex(ref string, idx v1.ImageIndex) error {
+	if err := s.writeIndexBlobs(idx); err != nil {
+		return err
+	}
+
+	return s.putManifest(idx, map[string]string{refNameAnnotation: ref})
+}
+
+// writeImageBlobs writes the layers, the config and the manifest of an image
+func (s *Store) writeImageBlobs(img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("failed to read layers: %w", err)
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return fmt.Errorf("failed to read layer digest: %w", err)
+		}
+		if s.HasBlob(digest) {
+			continue
+		}
+
+		rc, err := layer.Compressed()
+		if err != nil {
+			return fmt.Errorf("failed to fetch layer %s: %w", digest, err)
+		}
+		err = s.WriteBlob(digest, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write layer %s: %w", digest, err)
+		}
+	}
+
+	configName, err := img.ConfigName()
+	if err != nil {
+		return fmt.Errorf("failed to read config digest: %w", err)
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := s.WriteBlob(configName, bytes.NewReader(config)); err != nil {
+		return fmt.Errorf("failed to write config %s: %w", configName, err)
+	}
+
+	return s.writeManifestBlob(img)
+}
+
+// writeIndexBlobs writes the manifests of an index and everything they reference
+func (s *Store) writeIndexBlobs(idx v1.ImageIndex) error {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to read index %s: %w", desc.Digest, err)
+			}
+			if err := s.writeIndexBlobs(child); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to read image %s: %w", desc.Digest, err)
+			}
+			if err := s.writeImageBlobs(child); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported manifest %s of type %s in index", desc.Digest, desc.MediaType)
+		}
+	}
+
+	return s.writeManifestBlob(idx)
+}
+
+// writeManifestBlob writes the manifest of an image or an index
+func (s *Store) writeManifestBlob(manifest partial.Describable) error {
+	withRaw, ok := manifest.(partial.WithRawManifest)
+	if !ok {
+		return fmt.Errorf("manifest %T has no raw form", manifest)
+	}
+
+	digest, err := manifest.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to compute manifest digest: %w", err)
+	}
+	raw, err := withRaw.RawManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if err := s.WriteBlob(digest, bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", digest, err)
+	}
+	return nil
+}
+
+// putManifest registers an image or an index in the store index with the
+// given annotations
+func (s *Store) putManifest(manifest partial.Describable, annotations map[string]string) error {
+	desc, err := partial.Descriptor(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to describe manifest: %w", err)
+	}
+	desc.Annotations = annotations
+
+	return s.PutDescriptor(*desc)
+}
+
+// ImageIndex loads the image index stored under the given reference name
+func (s *Store) ImageIndex(ref string) (v1.ImageIndex, error) {
+	desc, err := s.Descriptor(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	root, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	return root.ImageIndex(desc.Digest)
+}
+
+// Image loads the image stored under the given reference name
+func (s *Store) Image(ref string) (v1.Image, error) {
+	desc, err := s.Descriptor(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.path.Image(desc.Digest)
+}
+
+// Descriptor returns the index descriptor of the given reference name
+func (s *Store) Descriptor(ref string) (*v1.Descriptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ii, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Annotations[refNameAnnotation] == ref {
+			desc := desc
+			return &desc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("image %s not found in store %s", ref, s.Path())
+}
+
+// Tag adds a new reference name pointing to the content of an existing one
+func (s *Store) Tag(sourceRef, targetRef string) error {
+	desc, err := s.Descriptor(sourceRef)
+	if err != nil {
+		return err
+	}
+
+	// Copy the descriptor with the new reference name
+	tagged := *desc
+	tagged.Annotations = make(map[string]string, len(desc.Annotations))
+	for k, v := range desc.Annotations {
+		tagged.Annotations[k] = v
+	}
+	tagged.Annotations[refNameAnnotation] = targetRef
+
+	if err := s.PutDescriptor(tagged); err != nil {
+		return err
+	}
+
+	return s.CopyReferrers(sourceRef, targetRef)
+}
+
+// WriteReferrer writes an artifact attached to the image stored under the
+// given reference name. The tag suffix is set for artifacts attached with the
+// cosign tag scheme and empty for OCI referrers.
+func (s *Store) WriteReferrer(subjectRef, tagSuffix string, artifact partial.WithRawManifest) error {
+	annotations := map[string]string{
+		referrerOfAnnotation:  subjectRef,
+		referrerTagAnnotation: tagSuffix,
+	}
+
+	switch artifact := artifact.(type) {
+	case *rawArtifact:
+		return s.writeRawArtifact(artifact, annotations)
+	case v1.ImageIndex:
+		if err := s.writeIndexBlobs(artifact); err != nil {
+			return err
+		}
+		return s.putManifest(artifact, annotations)
+	case v1.Image:
+		if err := s.writeImageBlobs(artifact); err != nil {
+			return err
+		}
+		return s.putManifest(artifact, annotations)
+	default:
+		return fmt.Errorf("unsupported referrer type %T", artifact)
+	}
+}
+
+// WriteArtifact writes an OCI artifact to the store under the given reference
+// name, replacing any entry previously stored under that name. The manifest
+// and its blobs are stored unchanged, whatever their media types.
+func (s *Store) WriteArtifact(ref string, artifact *rawArtifact) error {
+	return s.writeRawArtifact(artifact, map[string]string{
+		refNameAnnotation: ref,
+	})
+}
+
+// RawArtifact loads the artifact stored under the given reference name,
+// with its manifest and blobs as they were written
+func (s *Store) RawArtifact(ref string) (*rawArtifact, error) {
+	desc, err := s.Descriptor(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.path.Bytes(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+	}
+
+	return &rawArtifact{
+		desc:     *desc,
+		raw:      raw,
+		manifest: manifest,
+		fetch: func(blob v1.Descriptor) (io.ReadCloser, error) {
+			return s.Blob(blob.Digest)
+		},
+	}, nil
+}
+
+// writeRawArtifact copies the blobs and the manifest of an artifact, then
+// registers it in the store index with the given annotations
+func (s *Store) writeRawArtifact(artifact *rawArtifact, annotations map[string]string) error {
+	for _, blob := range artifact.Blobs() {
+		if s.HasBlob(blob.Digest) {
+			continue
+		}
+
+		rc, err := artifact.fetch(blob)
+		if err != nil {
+			return fmt.Errorf("failed to fetch blob %s: %w", blob.Digest, err)
+		}
+		err = s.WriteBlob(blob.Digest, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	if err := s.WriteBlob(artifact.desc.Digest, bytes.NewReader(artifact.raw)); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", artifact.desc.Digest, err)
+	}
+
+	desc := artifact.desc
+	desc.Annotations = annotations
+
+	return s.PutDescriptor(desc)
+}
+
+// Referrers returns the index descriptors of the artifacts attached to the
+// image stored under the given reference name
+func (s *Store) Referrers(ref string) ([]v1.Descriptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ii, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	referrers := make([]v1.Descriptor, 0)
+	for _, desc := range index.Manifests {
+		if desc.Annotations[referrerOfAnnotation] == ref {
+			referrers = append(referrers, desc)
+		}
+	}
+
+	return referrers, nil
+}
+
+// RemoveReferrers removes the artifacts attached to the given reference name
+// from the store index
+func (s *Store) RemoveReferrers(ref string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removeReferrers(ref)
+}
+
+// removeReferrers removes the referrers of a reference name; the caller
+// holds the write lock
+func (s *Store) removeReferrers(ref string) error {
+	if err := s.path.RemoveDescriptors(match.Annotation(referrerOfAnnotation, ref)); err != nil {
+		return fmt.Errorf("failed to remove referrers of %s: %w", ref, err)
+	}
+	return nil
+}
+
+// CopyReferrers attaches the artifacts of one reference name to another,
+// replacing those previously attached to the target
+func (s *Store) CopyReferrers(sourceRef, targetRef string) error {
+	referrers, err := s.Referrers(sourceRef)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.removeReferrers(targetRef); err != nil {
+		return err
+	}
+
+	for _, desc := range referrers {
+		copied := desc
+		copied.Annotations = make(map[string]string, len(desc.Annotations))
+		for k, v := range desc.Annotations {
+			copied.Annotations[k] = v
+		}
+		copied.Annotations[referrerOfAnnotation] = targetRef
+
+		if err := s.path.AppendDescriptor(copied); err != nil {
+			return fmt.Errorf("failed to copy referrer %s: %w", desc.Digest, err)
+		}
+	}
+
+	return nil
+}
+
+// Snapshot returns the entries of the store index that belong to a reference
+// name: the image itself and the artifacts attached to it. It is empty when
+// the store does not hold the reference name.
+func (s *Store) Snapshot(ref string) ([]v1.Descriptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ii, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index: %w", err)
+	}
+
+	entries := make([]v1.Descriptor, 0)
+	for _, desc := range index.Manifests {
+		if desc.Annotations[refNameAnnotation] == ref || desc.Annotations[referrerOfAnnotation] == ref {
+			entries = append(entries, desc)
+		}
+	}
+
+	return entries, nil
+}
+
+// Restore puts back the entries of a reference name taken by Snapshot. An
+// empty snapshot removes the reference name from the store. Blobs are kept,
+// as other images may share them.
+func (s *Store) Restore(ref string, entries []v1.Descriptor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.path.RemoveDescriptors(func(desc v1.Descriptor) bool {
+		return desc.Annotations[refNameAnnotation] == ref || desc.Annotations[referrerOfAnnotation] == ref
+	}); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", ref, err)
+	}
+
+	for _, desc := range entries {
+		if err := s.path.AppendDescriptor(desc); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", ref, err)
+		}
+	}
+
+	return nil
+}
+
+// Artifact loads the image or index described by an entry of the store index
+func (s *Store) Artifact(desc v1.Descriptor) (taggableArtifact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if desc.MediaType.IsIndex() {
+		root, err := s.path.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read store index: %w", err)
+		}
+		return root.ImageIndex(desc.Digest)
+	}
+
+	return s.path.Image(desc.Digest)
+}
+
+// refNameMatcher matches index descriptors by reference name
+func refNameMatcher(ref string) match.Matcher {
+	return match.Annotation(refNameAnnotation, ref)
+}
+
+// Blobs returns the descriptors of every blob needed by the given reference
+// name: the manifest itself followed by the blobs it references, then the
+// same for each artifact attached to it
+func (s *Store) Blobs(ref string) ([]v1.Descriptor, error) {
+	desc, err := s.Descriptor(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := s.manifestBlobs(*desc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Artifacts attached to the image travel with it
+	referrers, err := s.Referrers(ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, referrer := range referrers {
+		referrerBlobs, err := s.manifestBlobs(referrer)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, referrerBlobs...)
+	}
+
+	return blobs, nil
+}
+
+// manifestBlobs walks a manifest and collects the descriptors it depends on
+func (s *Store) manifestBlobs(desc v1.Descriptor) ([]v1.Descriptor, error) {
+	raw, err := s.path.Bytes(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+	}
+
+	blobs := []v1.Descriptor{desc}
+
+	// Image indexes reference other manifests
+	if desc.MediaType.IsIndex() {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse index %s: %w", desc.Digest, err)
+		}
+
+		for _, child := range index.Manifests {
+			childBlobs, err := s.manifestBlobs(child)
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, childBlobs...)
+		}
+
+		return blobs, nil
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+	}
+
+	blobs = append(blobs, manifest.Config)
+	blobs = append(blobs, manifest.Layers...)
+
+	return blobs, nil
+}
+
+// Blob opens a blob of the store
+func (s *Store) Blob(digest v1.Hash) (io.ReadCloser, error) {
+	return s.path.Blob(digest)
+}
+
+// HasBlob reports whether the blob exists in the store
+func (s *Store) HasBlob(digest v1.Hash) bool {
+	_, err := os.Stat(filepath.Join(s.Path(), "blobs", digest.Algorithm, digest.Hex))
+	return err == nil
+}
+
+// WriteBlob writes a blob to the store, verifying its digest while copying.
+// The blob is written to a temporary file renamed once complete, so that
+// concurrent writers of a shared layer never expose a partial blob.
+func (s *Store) WriteBlob(digest v1.Hash, r io.Reader) error {
+	if s.HasBlob(digest) {
+		return nil
+	}
+
+	verifier, err := newDigestVerifier(r, digest)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.Path(), "blobs", digest.Algorithm)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, digest.Hex+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, verifier)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, digest.Hex))
+}
+
+// PutDescriptor adds a descriptor to the store index, replacing any entry
+// with the same reference name, or the same artifact attached to the same image
+func (s *Store) PutDescriptor(desc v1.Descriptor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ref, ok := desc.Annotations[refNameAnnotation]; ok {
+		if err := s.path.RemoveDescriptors(refNameMatcher(ref)); err != nil {
+			return fmt.Errorf("failed to remove previous entry: %w", err)
+		}
+	}
+
+	if subject, ok := desc.Annotations[referrerOfAnnotation]; ok {
+		if err := s.path.RemoveDescriptors(func(d v1.Descriptor) bool {
+			return d.Digest == desc.Digest && d.Annotations[referrerOfAnnotation] == subject
+		}); err != nil {
+			return fmt.Errorf("failed to remove previous referrer: %w", err)
+		}
+	}
+
+	return s.path.AppendDescriptor(desc)
+}
+
+// digestVerifier fails the read at EOF when the content does not match the expected digest
+type digestVerifier struct {
+	reader   io.Reader
+	hasher   hash.Hash
+	expected v1.Hash
+}
+
+// newDigestVerifier returns a verifier of the content read from r, hashed
+// with the algorithm of the expected digest
+func newDigestVerifier(r io.Reader, expected v1.Hash) (*digestVerifier, error) {
+	var hasher hash.Hash
+	switch expected.Algorithm {
+	case "sha256":
+		hasher = sha256.New()
+	case "sha512":
+		hasher = sha512.New()
+	default:
+		return nil, fmt.Errorf("blob %s: unsupported digest algorithm %q", expected, expected.Algorithm)
+	}
+
+	return &digestVerifier{reader: r, hasher: hasher, expected: expected}, nil
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	v.hasher.Write(p[:n])
+
+	if err == io.EOF {
+		actual := hex.EncodeToString(v.hasher.Sum(nil))
+		if actual != v.expected.Hex {
+			return n, fmt.Errorf("blob %s is corrupt: computed %s:%s", v.expected, v.expected.Algorithm, actual)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// SyncOptions contains options for the mirroring of repositories
+type SyncOptions struct {
+	VerboseLevel int
+	KeepGoing    bool          // Carry on with the next tags after a failure
+	Prune        bool          // Delete the destination tags absent from the source
+	Force        bool          // Push images even when the destination already has the same manifest
+	Platforms    []v1.Platform // Platforms kept from multi-platform indexes (all if empty)
+	TLS          TLSOptions    // CA certificates and client certificates of the registries
+	Jobs         int           // Tags copied in parallel (1 if zero)
+	MaxConns     int           // Connections per registry host (uncapped if zero)
+	Retry        RetryPolicy   // Attempts on transient registry and network errors
+}
+
+// SyncHandler mirrors whole repositories: the image mappings of a block name
+// repositories, whose tags are all copied from the source to the destination.
+// Destination tags absent from the source are reported, and deleted when
+// pruning. Cosign signature, attestation and SBOM tags follow the image they
+// are attached to and are never pruned on their own.
+type SyncHandler struct {
+	ctx      context.Context
+	options  SyncOptions
+	logger   *log.Logger
+	session  *Session
+	transfer *TransferHandler
+}
+
+// syncedRepository is a repository mapping with its tags listed at both ends
+type syncedRepository struct {
+	destination name.Repository
+	stale       []string // Destination tags to prune
+	kept        []string // Destination tags left in place after the sync
+}
+
+// NewSyncHandler creates a new SyncHandler instance
+func NewSyncHandler(ctx context.Context, options SyncOptions, session *Session) *SyncHandler {
+	return &SyncHandler{
+		ctx:     ctx,
+		options: options,
+		logger:  log.New(log.Writer(), "[SYNC] ", log.LstdFlags),
+		session: session,
+		transfer: NewTransferHandler(ctx, TransferOptions{
+			VerboseLevel: options.VerboseLevel,
+			KeepGoing:    options.KeepGoing,
+			Platforms:    options.Platforms,
+			TLS:          options.TLS,
+			Jobs:         options.Jobs,
+			MaxConns:     options.MaxConns,
+			Retry:        options.Retry,
+			Force:        options.Force,
+		}, session),
+	}
+}
+
+// SyncImages mirrors the repositories of a block. Tags are copied as by a
+// direct transfer, reported in the COPY phase; destination tags absent from
+// the source are reported in the PRUNE phase once every copy succeeded.
+func (h *SyncHandler) SyncImages(block *Block) <-chan TransferResult {
+	results := make(chan TransferResult)
+
+	go func() {
+		defer close(results)
+
+		// Validate that the block is valid for sync
+		if err := h.validateSyncBlock(block); err != nil {
+			results <- TransferResult{Error: err}
+			return
+		}
+
+		// Get credentials for both registries, renewed during the sync when they expire
+		if _, err := h.session.GetCredentials(h.ctx, RoleSource, block.SourceRegistry.Host); err != nil {
+			results <- TransferResult{
+				Phase: PhaseCopy,
+				Error: fmt.Errorf("failed to get source credentials: %w", err),
+			}
+			return
+		}
+
+		if _, err := h.session.GetCredentials(h.ctx, RoleDestination, block.DestinationRegistry.Host); err != nil {
+			results <- TransferResult{
+				Phase: PhaseCopy,
+				Error: fmt.Errorf("failed to get destination credentials: %w", err),
+			}
+			return
+		}
+
+		sourceAuth := h.session.Authenticator(h.ctx, RoleSource, block.SourceRegistry.Host)
+		destAuth := h.session.Authenticator(h.ctx, RoleDestination, block.DestinationRegistry.Host)
+
+		// Compare the tags of each repository at both ends
+		tags := *block
+		tags.ImageMappings = make([]ImageMapping, 0)
+		repositories := make([]syncedRepository, 0, len(block.ImageMappings))
+		failed := false
+
+		for _, mapping := range block.ImageMappings {
+			copies, repository, err := h.compareTags(mapping, block, sourceAuth, destAuth)
+			if err != nil {
+				results <- TransferResult{
+					Phase:            PhaseCopy,
+					SourceImage:      block.SourceRegistry.Qualify(mapping.Source),
+					DestinationImage: block.DestinationRegistry.Qualify(mapping.Destination),
+					Error:            err,
+				}
+				if !h.options.KeepGoing {
+					return
+				}
+				failed = true
+				continue
+			}
+			tags.ImageMappings = append(tags.ImageMappings, copies...)
+			repositories = append(repositories, repository)
+		}
+
+		// Copy the source tags, those already up to date being skipped
+		copied := make(chan TransferResult)
+		go func() {
+			defer close(copied)
+			h.transfer.transferDirect(&tags, copied)
+		}()
+		for result := range copied {
+			results <- result
+			if result.Error != nil {
+				failed = true
+			}
+		}
+
+		// A failed copy may be retried; stale tags are only pruned after a
+		// clean run, or when told to keep going
+		if failed && !h.options.KeepGoing {
+			return
+		}
+
+		for _, repository := range repositories {
+			if !h.pruneRepository(repository, destAuth, results) && !h.options.KeepGoing {
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// compareTags lists the tags of a repository mapping at both ends. It returns
+// the image mappings of the source tags, and the destination tags absent
+// from the source that are not excluded.
+func (h *SyncHandler) compareTags(mapping ImageMapping, block *Block, sourceAuth, destAuth authn.Authenticator) ([]ImageMapping, syncedRepository, error) {
+	repository := syncedRepository{}
+
+	source, err := block.SourceRegistry.ParseRepository(mapping.Source)
+	if err != nil {
+		return nil, repository, fmt.Errorf("failed to parse source repository: %w", err)
+	}
+
+	destination, err := block.DestinationRegistry.ParseRepository(mapping.Destination)
+	if err != nil {
+		return nil, repository, fmt.Errorf("failed to parse destination repository: %w", err)
+	}
+	repository.destination = destination
+
+	sourceTags, err := h.listTags(source, sourceAuth)
+	if err != nil {
+		return nil, repository, fmt.Errorf("failed to list source tags: %w", err)
+	}
+
+	destTags, err := h.listTags(destination, destAuth)
+	if err != nil {
+		return nil, repository, fmt.Errorf("failed to list destination tags: %w", err)
+	}
+
+	// Source tags, copied with the artifacts attached to them
+	copies := make([]ImageMapping, 0, len(sourceTags))
+	inSource := make(map[string]bool, len(sourceTags))
+	for _, tag := range sourceTags {
+		if isReferrerTag(tag) {
+			continue
+		}
+		inSource[tag] = true
+		copies = append(copies, ImageMapping{
+			Source:      mapping.Source + ":" + tag,
+			Destination: mapping.Destination + ":" + tag,
+		})
+		repository.kept = append(repository.kept, tag)
+	}
+
+	// Destination tags no longer in the source
+	for _, tag := range destTags {
+		if isReferrerTag(tag) || inSource[tag] {
+			continue
+		}
+		stale := ImageMapping{
+			Source:      mapping.Source + ":" + tag,
+			Destination: mapping.Destination + ":" + tag,
+		}
+		if isExcluded(stale, block.Exclusions) {
+			repository.kept = append(repository.kept, tag)
+			continue
+		}
+		repository.stale = append(repository.stale, tag)
+	}
+
+	if h.options.VerboseLevel > 1 {
+		h.logger.Printf("%s: %d source tags, %d destination tags, %d stale", destination, len(inSource), len(destTags), len(repository.stale))
+	}
+
+	return copies, repository, nil
+}
+
+// pruneRepository reports the stale tags of a repository, deleting them when
+// pruning. It returns false on the first failure unless told to keep going.
+func (h *SyncHandler) pruneRepository(repository syncedRepository, destAuth authn.Authenticator, results chan<- TransferResult) bool {
+	ok := true
+
+	for _, tag := range repository.stale {
+		ref := repository.destination.Tag(tag)
+		result := TransferResult{
+			Phase:            PhasePrune,
+			DestinationImage: ref.Name(),
+		}
+
+		if h.options.Prune {
+			var retries int
+			result, retries = withRetry(h.ctx, h.options.Retry, repository.destination.RegistryStr(),
+				func(ctx context.Context) TransferResult {
+					attempt := result
+					opts, err := h.remoteOptions(ctx, repository.destination, destAuth)
+					if err == nil {
+						err = pruneTag(ref, repository.kept, opts)
+					}
+					if err != nil {
+						attempt.Error = fmt.Errorf("failed to delete tag: %w", err)
+					}
+					return attempt
+				},
+				func(result TransferResult) error { return result.Error },
+				func(retry int, delay time.Duration, err error) {
+					if h.options.VerboseLevel > 1 {
+						h.logger.Printf("retrying deletion of %s in %s (retry %d): %v", ref, delay.Round(time.Millisecond), retry, err)
+					}
+				},
+			)
+			result.Retries = retries
+		}
+
+		results <- result
+		if result.Error != nil {
+			if !h.options.KeepGoing {
+				return false
+			}
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// listTags lists the tags of a repository, none when it does not exist yet
+func (h *SyncHandler) listTags(repo name.Repository, auth authn.Authenticator) ([]string, error) {
+	type listing struct {
+		tags []string
+		err  error
+	}
+
+	result, _ := withRetry(h.ctx, h.options.Retry, repo.RegistryStr(),
+		func(ctx context.Context) listing {
+			opts, err := h.remoteOptions(ctx, repo, auth)
+			if err != nil {
+				return listing{err: err}
+			}
+			tags, err := remote.List(repo, opts...)
+			if isNotFound(err) {
+				return listing{}
+			}
+			return listing{tags: tags, err: err}
+		},
+		func(result listing) error { return result.err },
+		func(retry int, delay time.Duration, err error) {
+			if h.options.VerboseLevel > 1 {
+				h.logger.Printf("retrying tag listing of %s in %s (retry %d): %v", repo, delay.Round(time.Millisecond), retry, err)
+			}
+		},
+	)
+
+	return result.tags, result.err
+}
+
+// remoteOptions returns the options to reach the registry of a repository
+func (h *SyncHandler) remoteOptions(ctx context.Context, repo name.Repository, auth authn.Authenticator) ([]remote.Option, error) {
+	transport, err := h.transfer.transports.get(repo.RegistryStr())
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS: %w", err)
+	}
+
+	return []remote.Option{
+		remote.WithAuth(auth),
+		remote.WithContext(ctx),
+		remote.WithTransport(transport),
+		remote.WithRetryStatusCodes(), // Retried per operation, see withRetry
+	}, nil
+}
+
+// validateSyncBlock validates that the block is valid for sync: its image
+// mappings must name repositories, without tag or digest
+func (h *SyncHandler) validateSyncBlock(block *Block) error {
+	if err := h.transfer.validateTransferBlock(block); err != nil {
+		return err
+	}
+
+	for _, mapping := range block.ImageMappings {
+		if _, err := block.SourceRegistry.ParseRepository(mapping.Source); err != nil {
+			return fmt.Errorf("invalid source repository %q, sync mappings name repositories without tag or digest: %w", mapping.Source, err)
+		}
+		if _, err := block.DestinationRegistry.ParseRepository(mapping.Destination); err != nil {
+			return fmt.Errorf("invalid destination repository %q, sync mappings name repositories without tag or digest: %w", mapping.Destination, err)
+		}
+	}
+
+	return nil
+}
+
+// pruneTag deletes a destination tag. Registries that cannot delete a tag on
+// its own get the manifest deleted instead, provided no tag kept at the
+// destination points to it: deleting a manifest removes all of its tags.
+func pruneTag(tag name.Tag, kept []string, opts []remote.Option) error {
+	err := remote.Delete(tag, opts...)
+	if err == nil || isNotFound(err) {
+		return nil
+	}
+	if !isUnsupported(err) {
+		return err
+	}
+
+	desc, err := remote.Head(tag, opts...)
+	if isNotFound(err) {
+		return nil // Deleted with the manifest of another stale tag
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, other := range kept {
+		shared, err := remote.Head(tag.Context().Tag(other), opts...)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if shared.Digest == desc.Digest {
+			return fmt.Errorf("the registry cannot delete tag %s alone, and its manifest is also tagged %s", tag.TagStr(), other)
+		}
+	}
+
+	return remote.Delete(tag.Context().Digest(desc.Digest.String()), opts...)
+}
+
+// isUnsupported reports whether a registry refused a request it does not
+// implement, as registries that only delete manifests by digest, or that lack
+// the referrers API, do
+func isUnsupported(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && (terr.StatusCode == http.StatusBadRequest || terr.StatusCode == http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// TLSOptions contains the TLS material used to reach registries. Files
+// found in the per-host directory of CertsDir, laid out like containerd's
+// certs.d, apply to that host; the explicit files apply to every registry.
+type TLSOptions struct {
+	CertsDir   string // Root of the per-host directories (default certs directory if empty)
+	CACert     string // Additional CA bundle trusted for every registry
+	ClientCert string // Client certificate presented to every registry
+	ClientKey  string // Key of the client certificate
+}
+
+// DefaultCertsDir returns the default root of the per-host certificate
+// directories under the user config directory
+func DefaultCertsDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user config directory: %w", err)
+	}
+
+	return filepath.Join(configDir, "magina", "certs.d"), nil
+}
+
+// Transport returns the HTTP transport to use for the given registry host.
+// The default transport is returned when no TLS material applies to it.
+func (o TLSOptions) Transport(host string) (http.RoundTripper, error) {
+	caFiles, certFile, keyFile, err := o.hostFiles(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Explicit files override the per-host directory
+	if o.CACert != "" {
+		caFiles = append(caFiles, o.CACert)
+	}
+	if o.ClientCert != "" || o.ClientKey != "" {
+		if o.ClientCert == "" || o.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		certFile, keyFile = o.ClientCert, o.ClientKey
+	}
+
+	if len(caFiles) == 0 && certFile == "" {
+		return remote.DefaultTransport, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// Private CAs are trusted in addition to the system ones
+	if len(caFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range caFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", caFile)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	// Client certificate for mTLS
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate for %s: %w", host, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := remote.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return transport, nil
+}
+
+// hostFiles lists the TLS files of a host directory: every *.crt file is a
+// CA certificate and client.cert goes with client.key. A missing directory
+// is not an error.
+func (o TLSOptions) hostFiles(host string) (caFiles []string, certFile, keyFile string, err error) {
+	certsDir := o.CertsDir
+	if certsDir == "" {
+		if certsDir, err = DefaultCertsDir(); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	hostDir := filepath.Join(certsDir, host)
+	entries, err := os.ReadDir(hostDir)
+	if os.IsNotExist(err) {
+		return nil, "", "", nil
+	}
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read certificates directory %s: %w", hostDir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".crt") {
+			caFiles = append(caFiles, filepath.Join(hostDir, entry.Name()))
+		}
+	}
+
+	certFile = filepath.Join(hostDir, "client.cert")
+	keyFile = filepath.Join(hostDir, "client.key")
+	if _, err := os.Stat(certFile); err != nil {
+		return caFiles, "", "", nil
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		return nil, "", "", fmt.Errorf("%s has no matching client.key", certFile)
+	}
+
+	return caFiles, certFile, keyFile, nil
+}
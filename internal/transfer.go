@@ -4,6 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 // TransferPhase represents a phase in the transfer process
@@ -13,13 +19,24 @@ const (
 	PhaseExport  TransferPhase = "EXPORT"
 	PhaseConvert TransferPhase = "CONVERT"
 	PhaseImport  TransferPhase = "IMPORT"
+	PhaseCopy    TransferPhase = "COPY"  // Direct copy from the source to the destination registry
+	PhasePrune   TransferPhase = "PRUNE" // Destination tags absent from the source, see SyncHandler
 )
 
 // TransferOptions contains options for the transfer process
 type TransferOptions struct {
-	CleanOnError  bool
-	VerboseLevel  int
-	ResumeOnError bool
+	VerboseLevel int
+	KeepGoing    bool          // Carry on with the next images after a failure
+	Staged       bool          // Stage images in the local store (export, convert, import) instead of copying them directly
+	StorePath    string        // Local OCI layout directory used as staging area
+	Platforms    []v1.Platform // Platforms kept from multi-platform indexes (all if empty)
+	TLS          TLSOptions    // CA certificates and client certificates of the registries
+	Jobs         int           // Images processed in parallel (in each phase when staged, 1 if zero)
+	MaxConns     int           // Connections per registry host (uncapped if zero)
+	Retry        RetryPolicy   // Attempts on transient registry and network errors
+	Journal      *Journal      // Images completed by a previous run, skipped when resuming (nil to disable)
+	Rollback     *Rollback     // Records the artifacts written, to undo them if the run fails (nil to keep them)
+	Force        bool          // Push images even when the destination already has the same manifest
 }
 
 // TransferResult represents the result of a transfer operation
@@ -28,28 +45,36 @@ type TransferResult struct {
 	SourceImage      string
 	LocalImage       string
 	DestinationImage string
+	Referrers        int  // Signatures, SBOMs and attestations copied with the image
+	Retries          int  // Attempts made after the first one failed on a transient error
+	Resumed          bool // Already done by a previous run, per the journal
+	Skipped          bool // The destination tag already pointed to the same manifest
 	Error            error
 }
 
 // TransferHandler manages the complete transfer workflow
 type TransferHandler struct {
-	ctx     context.Context
-	options TransferOptions
-	logger  *log.Logger
-	session *Session
+	ctx        context.Context
+	options    TransferOptions
+	logger     *log.Logger
+	session    *Session
+	transports *hostTransports
 }
 
 // NewTransferHandler creates a new TransferHandler instance
 func NewTransferHandler(ctx context.Context, options TransferOptions, session *Session) *TransferHandler {
 	return &TransferHandler{
-		ctx:     ctx,
-		options: options,
-		logger:  log.New(log.Writer(), "[TRANSFER] ", log.LstdFlags),
-		session: session,
+		ctx:        ctx,
+		options:    options,
+		logger:     log.New(log.Writer(), "[TRANSFER] ", log.LstdFlags),
+		session:    session,
+		transports: newHostTransports(options.TLS, options.MaxConns),
 	}
 }
 
-// TransferImages executes the complete transfer workflow
+// TransferImages executes the complete transfer workflow. Each image is
+// copied from the source to the destination registry in a single pass, or
+// through the local store when the transfer is staged.
 func (h *TransferHandler) TransferImages(block *Block) <-chan TransferResult {
 	results := make(chan TransferResult)
 
@@ -62,88 +87,375 @@ func (h *TransferHandler) TransferImages(block *Block) <-chan TransferResult {
 			return
 		}
 
-		// Get credentials for source registry
-		sourceCreds, err := h.session.GetCredentials(block.SourceRegistry.Host)
-		if err != nil {
-			results <- TransferResult{
-				Phase: PhaseExport,
-				Error: fmt.Errorf("failed to get source credentials: %w", err),
-			}
-			return
+		if h.options.Staged {
+			h.transferStaged(block, results)
+		} else {
+			h.transferDirect(block, results)
 		}
+	}()
 
-		// Get credentials for destination registry
-		destCreds, err := h.session.GetCredentials(block.DestinationRegistry.Host)
-		if err != nil {
-			results <- TransferResult{
-				Phase: PhaseImport,
-				Error: fmt.Errorf("failed to get destination credentials: %w", err),
-			}
-			return
+	return results
+}
+
+// transferDirect copies the images of a block from the source to the
+// destination registry. Blobs are streamed from one registry to the other
+// without touching the disk, or mounted when both repositories sit on the
+// same registry.
+func (h *TransferHandler) transferDirect(block *Block, results chan<- TransferResult) {
+	// Get credentials for both registries, renewed during the copy when they expire
+	if _, err := h.session.GetCredentials(h.ctx, RoleSource, block.SourceRegistry.Host); err != nil {
+		results <- TransferResult{
+			Phase: PhaseCopy,
+			Error: fmt.Errorf("failed to get source credentials: %w", err),
 		}
+		return
+	}
 
-		// Export phase
-		exportOpts := ExportOptions{
-			CleanOnError: h.options.CleanOnError,
-			VerboseLevel: h.options.VerboseLevel,
-			Credentials:  sourceCreds,
-		}
-		exportHandler := NewExportHandler(h.ctx, exportOpts)
-		exportResults := exportHandler.ExportImages(block)
-		for result := range exportResults {
-			results <- TransferResult{
-				Phase:       PhaseExport,
-				SourceImage: result.SourceImage,
-				LocalImage:  result.LocalImage,
-				Error:       result.Error,
+	if _, err := h.session.GetCredentials(h.ctx, RoleDestination, block.DestinationRegistry.Host); err != nil {
+		results <- TransferResult{
+			Phase: PhaseCopy,
+			Error: fmt.Errorf("failed to get destination credentials: %w", err),
+		}
+		return
+	}
+
+	sourceAuth := h.session.Authenticator(h.ctx, RoleSource, block.SourceRegistry.Host)
+	destAuth := h.session.Authenticator(h.ctx, RoleDestination, block.DestinationRegistry.Host)
+
+	// Collect the image mappings that are not excluded
+	mappings := make([]ImageMapping, 0, len(block.ImageMappings))
+	for _, mapping := range block.ImageMappings {
+		if !isExcluded(mapping, block.Exclusions) {
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	// Stop the images in progress at the first failure unless told to keep going
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+	stopped := false
+
+	policy := h.options.Retry.between(registryHost(block.SourceRegistry.Host), registryHost(block.DestinationRegistry.Host))
+
+	runOrdered(ctx, h.options.Jobs, mappings,
+		func(mapping ImageMapping) TransferResult {
+			result, retries := withRetry(ctx, policy, "",
+				func(ctx context.Context) TransferResult {
+					return h.copySingleImage(ctx, mapping, block, sourceAuth, destAuth)
+				},
+				func(result TransferResult) error { return result.Error },
+				func(retry int, delay time.Duration, err error) {
+					if h.options.VerboseLevel > 1 {
+						h.logger.Printf("retrying %s in %s (retry %d): %v", mapping.Source, delay.Round(time.Millisecond), retry, err)
+					}
+				},
+			)
+			result.Retries = retries
+			return result
+		},
+		func(mapping ImageMapping, err error) TransferResult {
+			return TransferResult{
+				Phase:            PhaseCopy,
+				SourceImage:      block.SourceRegistry.Qualify(mapping.Source),
+				DestinationImage: block.DestinationRegistry.Qualify(mapping.Destination),
+				Error:            err,
 			}
-			if result.Error != nil && !h.options.ResumeOnError {
+		},
+		func(result TransferResult) {
+			if stopped {
 				return
 			}
+			results <- result
+			if result.Error != nil && !h.options.KeepGoing {
+				stopped = true
+				cancel()
+			}
+		},
+	)
+}
+
+// copySingleImage copies one image, index or artifact and the artifacts
+// attached to it from the source to the destination registry
+func (h *TransferHandler) copySingleImage(ctx context.Context, mapping ImageMapping, block *Block, sourceAuth, destAuth authn.Authenticator) TransferResult {
+	result := TransferResult{
+		Phase:            PhaseCopy,
+		SourceImage:      block.SourceRegistry.Qualify(mapping.Source),
+		DestinationImage: block.DestinationRegistry.Qualify(mapping.Destination),
+	}
+
+	sourceRef, err := block.SourceRegistry.ParseReference(mapping.Source)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to parse source image reference: %w", err)
+		return result
+	}
+
+	destRef, err := block.DestinationRegistry.ParseReference(mapping.Destination)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to parse destination image reference: %w", err)
+		return result
+	}
+
+	// TLS material of both registries
+	sourceTransport, err := h.transports.get(sourceRef.Context().RegistryStr())
+	if err != nil {
+		result.Error = fmt.Errorf("failed to configure TLS: %w", err)
+		return result
+	}
+
+	destTransport, err := h.transports.get(destRef.Context().RegistryStr())
+	if err != nil {
+		result.Error = fmt.Errorf("failed to configure TLS: %w", err)
+		return result
+	}
+
+	sourceOpts := []remote.Option{
+		remote.WithAuth(sourceAuth),
+		remote.WithContext(ctx),
+		remote.WithTransport(sourceTransport),
+		remote.WithRetryStatusCodes(), // Retried per image, see withRetry
+	}
+	destOpts := []remote.Option{
+		remote.WithAuth(destAuth),
+		remote.WithContext(ctx),
+		remote.WithTransport(destTransport),
+		remote.WithRetryStatusCodes(),
+	}
+
+	// Skip an image a previous run copied, if the destination still has it
+	registries := block.SourceRegistry.URL() + "|" + block.DestinationRegistry.URL()
+	if digest, ok := h.options.Journal.Completed(PhaseCopy, registries, mapping.Source, mapping.Destination); ok {
+		if pushed, err := remote.Head(destRef, destOpts...); err == nil && pushed.Digest.String() == digest {
+			result.Resumed = true
+			return result
 		}
+	}
+
+	// Only the manifest is read here; blobs are fetched while being pushed
+	descriptor, err := remote.Get(sourceRef, sourceOpts...)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to load source image: %w", err)
+		return result
+	}
+
+	// Descriptor of the manifest pushed, which differs from the source one
+	// when platforms were filtered out
+	target := descriptor.Descriptor
 
-		// Convert phase
-		convertOpts := ConvertOptions{
-			CleanOnError: h.options.CleanOnError,
-			VerboseLevel: h.options.VerboseLevel,
-		}
-		convertHandler := NewConvertHandler(h.ctx, convertOpts)
-		convertResults := convertHandler.ConvertImages(block)
-		for result := range convertResults {
-			results <- TransferResult{
-				Phase:            PhaseConvert,
-				SourceImage:      result.SourceImage,
-				LocalImage:       result.LocalImage,
-				DestinationImage: result.DestinationImage,
-				Error:            result.Error,
+	// The manifest is pushed once the destination is checked
+	var push func() error
+	if descriptor.MediaType.IsIndex() {
+		idx, err := descriptor.ImageIndex()
+		if err != nil {
+			result.Error = fmt.Errorf("failed to get index from descriptor: %w", err)
+			return result
+		}
+
+		if idx, err = filterPlatforms(idx, h.options.Platforms); err != nil {
+			result.Error = err
+			return result
+		}
+
+		if len(h.options.Platforms) > 0 {
+			desc, err := partial.Descriptor(idx)
+			if err != nil {
+				result.Error = fmt.Errorf("failed to describe filtered index: %w", err)
+				return result
 			}
-			if result.Error != nil && !h.options.ResumeOnError {
-				return
+			target = *desc
+		}
+
+		// Push the index and all its children
+		push = func() error {
+			if err := remote.WriteIndex(destRef, idx, destOpts...); err != nil {
+				return fmt.Errorf("failed to push index: %w", err)
 			}
+			return nil
+		}
+	} else if isArtifact(descriptor) {
+		// Copy artifacts (Helm charts, WASM modules…) without interpreting their media types
+		artifact, err := newRemoteArtifact(sourceRef.Context(), descriptor, sourceOpts)
+		if err != nil {
+			result.Error = err
+			return result
 		}
 
-		// Import phase
-		importOpts := ImportOptions{
-			CleanOnError: h.options.CleanOnError,
-			VerboseLevel: h.options.VerboseLevel,
-			Credentials:  destCreds,
-		}
-		importHandler := NewImportHandler(h.ctx, importOpts)
-		importResults := importHandler.ImportImages(block)
-		for result := range importResults {
-			results <- TransferResult{
-				Phase:            PhaseImport,
-				LocalImage:       result.LocalImage,
-				DestinationImage: result.DestinationImage,
-				Error:            result.Error,
+		push = func() error {
+			if err := pushArtifact(destRef, artifact, destOpts); err != nil {
+				return fmt.Errorf("failed to push artifact: %w", err)
 			}
-			if result.Error != nil && !h.options.ResumeOnError {
-				return
+			return nil
+		}
+	} else {
+		img, err := descriptor.Image()
+		if err != nil {
+			result.Error = fmt.Errorf("failed to get image from descriptor: %w", err)
+			return result
+		}
+
+		push = func() error {
+			if err := remote.Write(destRef, img, destOpts...); err != nil {
+				return fmt.Errorf("failed to push image: %w", err)
 			}
+			return nil
 		}
-	}()
+	}
 
-	return results
+	// Leave the destination alone when its tag already points to the manifest
+	if !h.options.Force && isUpToDate(destRef, target.Digest, destOpts) {
+		result.Skipped = true
+	} else {
+		// Remember what the tag pointed to, to restore it on failure
+		if err := h.options.Rollback.trackRemote(destRef, target.Digest, destOpts); err != nil {
+			result.Error = err
+			return result
+		}
+
+		if err := push(); err != nil {
+			result.Error = err
+			return result
+		}
+	}
+
+	// Bring the artifacts attached to the source manifest along
+	var referrersLogger *log.Logger
+	if h.options.VerboseLevel > 0 {
+		referrersLogger = h.logger
+	}
+	if result.Referrers, err = copyReferrers(sourceRef.Context(), descriptor.Digest, destRef.Context(), target, sourceOpts, referrerPush{opts: destOpts, rollback: h.options.Rollback, force: h.options.Force}, referrersLogger); err != nil {
+		result.Error = fmt.Errorf("failed to copy referrers: %w", err)
+		return result
+	}
+
+	// Remember the image for a resumed run
+	if err := h.options.Journal.Record(PhaseCopy, registries, mapping.Source, mapping.Destination, target.Digest.String()); err != nil {
+		h.logger.Printf("failed to update journal: %v", err)
+	}
+
+	// Log success if verbose
+	if h.options.VerboseLevel > 0 && result.Skipped {
+		h.logger.Printf("Image already up to date: %s", result.DestinationImage)
+	} else if h.options.VerboseLevel > 0 {
+		h.logger.Printf("Image copied successfully: %s -> %s", result.SourceImage, result.DestinationImage)
+	}
+
+	return result
+}
+
+// transferStaged runs the export, convert and import phases one after the
+// other through the local store, reporting the result of each phase
+func (h *TransferHandler) transferStaged(block *Block, results chan<- TransferResult) {
+	// Stop the phase in progress at the first failure unless told to keep going
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+
+	// Get credentials for source registry
+	if _, err := h.session.GetCredentials(ctx, RoleSource, block.SourceRegistry.Host); err != nil {
+		results <- TransferResult{
+			Phase: PhaseExport,
+			Error: fmt.Errorf("failed to get source credentials: %w", err),
+		}
+		return
+	}
+
+	// Get credentials for destination registry
+	if _, err := h.session.GetCredentials(ctx, RoleDestination, block.DestinationRegistry.Host); err != nil {
+		results <- TransferResult{
+			Phase: PhaseImport,
+			Error: fmt.Errorf("failed to get destination credentials: %w", err),
+		}
+		return
+	}
+
+	// Export phase
+	exportOpts := ExportOptions{
+		Rollback:     h.options.Rollback,
+		VerboseLevel: h.options.VerboseLevel,
+		Auth:         h.session.Authenticator(ctx, RoleSource, block.SourceRegistry.Host),
+		StorePath:    h.options.StorePath,
+		Platforms:    h.options.Platforms,
+		TLS:          h.options.TLS,
+		Jobs:         h.options.Jobs,
+		MaxConns:     h.options.MaxConns,
+		Retry:        h.options.Retry,
+		Journal:      h.options.Journal,
+	}
+	exportHandler := NewExportHandler(ctx, exportOpts)
+	exportResults := exportHandler.ExportImages(stageBlock(block, func(m ImageMapping) ImageMapping {
+		return ImageMapping{Source: m.Source, Destination: m.Source}
+	}))
+	for result := range exportResults {
+		results <- TransferResult{
+			Phase:       PhaseExport,
+			SourceImage: result.SourceImage,
+			LocalImage:  result.LocalImage,
+			Referrers:   result.Referrers,
+			Retries:     result.Retries,
+			Resumed:     result.Resumed,
+			Error:       result.Error,
+		}
+		if result.Error != nil && !h.options.KeepGoing {
+			drain(cancel, exportResults)
+			return
+		}
+	}
+
+	// Convert phase
+	convertOpts := ConvertOptions{
+		Rollback:     h.options.Rollback,
+		VerboseLevel: h.options.VerboseLevel,
+		StorePath:    h.options.StorePath,
+		Jobs:         h.options.Jobs,
+	}
+	convertHandler := NewConvertHandler(ctx, convertOpts)
+	convertResults := convertHandler.ConvertImages(block)
+	for result := range convertResults {
+		results <- TransferResult{
+			Phase:            PhaseConvert,
+			SourceImage:      result.SourceImage,
+			LocalImage:       result.LocalImage,
+			DestinationImage: result.DestinationImage,
+			Error:            result.Error,
+		}
+		if result.Error != nil && !h.options.KeepGoing {
+			drain(cancel, convertResults)
+			return
+		}
+	}
+
+	// Import phase
+	importOpts := ImportOptions{
+		Rollback:     h.options.Rollback,
+		VerboseLevel: h.options.VerboseLevel,
+		Auth:         h.session.Authenticator(ctx, RoleDestination, block.DestinationRegistry.Host),
+		StorePath:    h.options.StorePath,
+		Platforms:    h.options.Platforms,
+		TLS:          h.options.TLS,
+		Jobs:         h.options.Jobs,
+		MaxConns:     h.options.MaxConns,
+		Retry:        h.options.Retry,
+		Journal:      h.options.Journal,
+		Force:        h.options.Force,
+	}
+	importHandler := NewImportHandler(ctx, importOpts)
+	importResults := importHandler.ImportImages(stageBlock(block, func(m ImageMapping) ImageMapping {
+		return ImageMapping{Source: m.Destination, Destination: m.Destination}
+	}))
+	for result := range importResults {
+		results <- TransferResult{
+			Phase:            PhaseImport,
+			LocalImage:       result.LocalImage,
+			DestinationImage: result.DestinationImage,
+			Referrers:        result.Referrers,
+			Retries:          result.Retries,
+			Resumed:          result.Resumed,
+			Skipped:          result.Skipped,
+			Error:            result.Error,
+		}
+		if result.Error != nil && !h.options.KeepGoing {
+			drain(cancel, importResults)
+			return
+		}
+	}
 }
 
 // validateTransferBlock validates that the block is valid for transfer
@@ -166,3 +478,28 @@ func (h *TransferHandler) validateTransferBlock(block *Block) error {
 
 	return nil
 }
+
+// drain cancels a phase and waits for its images in progress, so that
+// nothing is written once the transfer has stopped
+func drain[R any](cancel context.CancelFunc, results <-chan R) {
+	cancel()
+	for range results {
+	}
+}
+
+// stageBlock returns a copy of the block with its image mappings rewritten
+// for a single phase. Images are stored locally under their source name after
+// export and under their destination name after convert.
+func stageBlock(block *Block, rewrite func(ImageMapping) ImageMapping) *Block {
+	if block == nil {
+		return nil
+	}
+
+	staged := *block
+	staged.ImageMappings = make([]ImageMapping, 0, len(block.ImageMappings))
+	for _, mapping := range block.ImageMappings {
+		staged.ImageMappings = append(staged.ImageMappings, rewrite(mapping))
+	}
+
+	return &staged
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BundleVolume describes one volume of a split bundle
+type BundleVolume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// VolumeError reports a missing or corrupt volume of a split bundle
+type VolumeError struct {
+	Volume string
+	Reason string
+}
+
+func (e *VolumeError) Error() string {
+	return fmt.Sprintf("volume %s is %s", e.Volume, e.Reason)
+}
+
+// sizeUnits maps size suffixes to their multiplier
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a human readable size such as "4GiB", "700MB" or "1024"
+func ParseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	if value == "" {
+		return 0, fmt.Errorf("size cannot be empty")
+	}
+
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
+
+// volumeName returns the file name of the n-th volume (starting at 1)
+func volumeName(bundlePath string, n int) string {
+	return fmt.Sprintf("%s.%03d", bundlePath, n)
+}
+
+// volumeWriter splits a stream into numbered volume files of a maximum size
+type volumeWriter struct {
+	bundlePath string
+	maxSize    int64
+	current    *os.File
+	written    int64
+	hasher     hash.Hash
+	volumes    []BundleVolume
+}
+
+// newVolumeWriter creates a writer producing volumes of at most maxSize bytes
+func newVolumeWriter(bundlePath string, maxSize int64) *volumeWriter {
+	return &volumeWriter{
+		bundlePath: bundlePath,
+		maxSize:    maxSize,
+	}
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.current == nil || w.written == w.maxSize {
+			if err := w.next(); err != nil {
+				return total, err
+			}
+		}
+
+		chunk := p
+		if remaining := w.maxSize - w.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := w.current.Write(chunk)
+		w.hasher.Write(chunk[:n])
+		w.written += int64(n)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to write volume %s: %w", w.current.Name(), err)
+		}
+
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// next closes the current volume and opens the following one
+func (w *volumeWriter) next() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(volumeName(w.bundlePath, len(w.volumes)+1))
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %w", err)
+	}
+
+	w.current = file
+	w.written = 0
+	w.hasher = sha256.New()
+
+	return nil
+}
+
+// finish closes the current volume and records its checksum
+func (w *volumeWriter) finish() error {
+	if w.current == nil {
+		return nil
+	}
+
+	if err := w.current.Close(); err != nil {
+		return fmt.Errorf("failed to close volume %s: %w", w.current.Name(), err)
+	}
+
+	w.volumes = append(w.volumes, BundleVolume{
+		Name:   filepath.Base(w.current.Name()),
+		Size:   w.written,
+		SHA256: hex.EncodeToString(w.hasher.Sum(nil)),
+	})
+	w.current = nil
+
+	return nil
+}
+
+// Close closes the last volume
+func (w *volumeWriter) Close() error {
+	return w.finish()
+}
+
+// Volumes returns the volumes written so far
+func (w *volumeWriter) Volumes() []BundleVolume {
+	return w.volumes
+}
+
+// volumeReader reassembles the volumes of a split bundle as a single stream,
+// verifying the checksum of each volume once it has been fully read
+type volumeReader struct {
+	dir     string
+	volumes []BundleVolume
+	index   int
+	current *os.File
+	read    int64
+	hasher  hash.Hash
+}
+
+// newVolumeReader checks that every volume is present with the expected size
+// and returns a reader over their concatenated content
+func newVolumeReader(dir string, volumes []BundleVolume) (*volumeReader, error) {
+	if len(volumes) == 0 {
+		return nil, fmt.Errorf("bundle index lists no volumes")
+	}
+
+	for _, volume := range volumes {
+		info, err := os.Stat(filepath.Join(dir, volume.Name))
+		if err != nil {
+			return nil, &VolumeError{Volume: volume.Name, Reason: "missing"}
+		}
+		if info.Size() != volume.Size {
+			return nil, &VolumeError{Volume: volume.Name, Reason: fmt.Sprintf("corrupt: expected %d bytes, found %d", volume.Size, info.Size())}
+		}
+	}
+
+	return &volumeReader{dir: dir, volumes: volumes, index: -1}, nil
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.index+1 >= len(r.volumes) {
+				return 0, io.EOF
+			}
+			if err := r.open(r.index + 1); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.current.Read(p)
+		r.hasher.Write(p[:n])
+		r.read += int64(n)
+
+		if err == io.EOF {
+			if err := r.verify(); err != nil {
+				return n, err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil {
+			return n, &VolumeError{Volume: r.Current(), Reason: "unreadable: " + err.Error()}
+		}
+
+		return n, nil
+	}
+}
+
+// open opens the i-th volume
+func (r *volumeReader) open(i int) error {
+	file, err := os.Open(filepath.Join(r.dir, r.volumes[i].Name))
+	if err != nil {
+		return &VolumeError{Volume: r.volumes[i].Name, Reason: "missing"}
+	}
+
+	r.index = i
+	r.current = file
+	r.read = 0
+	r.hasher = sha256.New()
+
+	return nil
+}
+
+// verify closes the current volume and compares its checksum
+func (r *volumeReader) verify() error {
+	volume := r.volumes[r.index]
+	r.current.Close()
+	r.current = nil
+
+	if sum := hex.EncodeToString(r.hasher.Sum(nil)); sum != volume.SHA256 || r.read != volume.Size {
+		return &VolumeError{Volume: volume.Name, Reason: "corrupt: checksum mismatch"}
+	}
+
+	return nil
+}
+
+// Current returns the name of the volume being read
+func (r *volumeReader) Current() string {
+	if r.index < 0 {
+		return r.volumes[0].Name
+	}
+	return r.volumes[r.index].Name
+}
+
+// Close closes the volume being read
+func (r *volumeReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}